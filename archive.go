@@ -0,0 +1,322 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shurcooL/githubv4"
+)
+
+const (
+	// the issues, prs, issue history and change events are sharded by month
+	// under these directories
+	archiveIssuesDir  = "issues"
+	archivePRsDir     = "prs"
+	archiveHistoryDir = "history"
+	archiveEventsDir  = "events"
+	// the files of the archives written before the shards
+	archiveIssuesPath  = "issues.json"
+	archivePRsPath     = "prs.json"
+	archiveHistoryPath = "history.json"
+	archiveEventsPath  = "events.json"
+	archiveSyncPath    = "sync.json"
+	archiveSeenPath    = "seen.json"
+)
+
+// Archive holds everything the tracker synced, kept by a Storage.
+type Archive struct {
+	// mu serializes the saves of the sync workers.
+	mu           sync.Mutex
+	storage      Storage
+	Issues       *TrackedIssues
+	PullRequests *TrackedPullRequests
+	Sync         *SyncState
+	Events       *EventLog
+	// broken keeps the stored nodes Load couldn't decode, for fsck.
+	broken []brokenNode
+	// partial tells the storage failed to load the archive, what it didn't
+	// read yet would be lost by a save.
+	partial bool
+	// pages counts the checkpoints since the last save.
+	pages int
+}
+
+// checkpointPages is how many pages a sync fetches between two saves of an
+// archive its storage rewrites whole, a sync resuming after a crash fetches
+// the pages since the last save again.
+const checkpointPages = 50
+
+func NewArchive(storage Storage) *Archive {
+	return &Archive{
+		storage:      storage,
+		Issues:       &TrackedIssues{},
+		PullRequests: &TrackedPullRequests{},
+		Sync:         &SyncState{},
+		Events:       &EventLog{},
+	}
+}
+
+// Load reads the archive from the storage, the nodes that don't decode are
+// left out and make it fail once the rest is loaded.
+func (a *Archive) Load() error {
+	a.broken, a.partial = nil, false
+	if err := a.storage.Load(a); err != nil {
+		a.partial = true
+		return err
+	}
+	if len(a.broken) != 0 {
+		b := a.broken[0]
+		return fmt.Errorf("%d stored nodes don't decode, the first one at %s: %v, -fsck tells more", len(a.broken), b.where, b.err)
+	}
+	return nil
+}
+
+// dropBroken forgets the broken nodes of id, once it is refetched.
+func (a *Archive) dropBroken(id githubv4.ID) {
+	broken := a.broken[:0]
+	for _, b := range a.broken {
+		if b.id == "" || githubv4.ID(b.id) != id {
+			broken = append(broken, b)
+		}
+	}
+	a.broken = broken
+}
+
+// Checkpoint saves a after a page fetched by a sync. The zip storage rewrites
+// the whole archive on every save, so only every checkpointPages pages are.
+func (a *Archive) Checkpoint() error {
+	if _, ok := a.storage.(*zipStorage); ok {
+		a.mu.Lock()
+		a.pages++
+		due := a.pages >= checkpointPages
+		a.mu.Unlock()
+		if !due {
+			return nil
+		}
+	}
+	return a.Save()
+}
+
+// Save logs the changes found since the last save and hands them to the
+// storage along with the nodes changed, they are handed again by the next
+// save if this one fails.
+func (a *Archive) Save() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pages = 0
+	a.Events.append(a.Issues.takeEvents())
+	a.Events.append(a.PullRequests.takeEvents())
+	events := a.Events.unsaved()
+	issues := a.Issues.takeDirty()
+	prs := a.PullRequests.takeDirty()
+	err := a.storage.Save(a, issues, prs, events)
+	if err == nil {
+		a.Events.markSaved(len(events))
+	} else {
+		a.Issues.mu.Lock()
+		for _, issue := range issues {
+			a.Issues.markDirty(issue.ID)
+		}
+		a.Issues.mu.Unlock()
+		a.PullRequests.mu.Lock()
+		for _, pr := range prs {
+			a.PullRequests.markDirty(pr.ID)
+		}
+		a.PullRequests.mu.Unlock()
+	}
+	return err
+}
+
+// Import merges everything in src, nodes already tracked in a newer version
+// are kept. The sync state of src is taken for the repositories a doesn't
+// know yet.
+func (a *Archive) Import(src *Archive) (issues int, prs int) {
+	added, updated := a.Issues.Add(src.Issues.issues)
+	issues = added + updated
+	a.Issues.mergeHistory(src.Issues)
+	added, updated = a.PullRequests.Add(src.PullRequests.prs)
+	prs = added + updated
+	// the changes of src are its own, not found by a sync of a
+	a.Issues.takeEvents()
+	a.PullRequests.takeEvents()
+	if len(a.Events.Since(0)) == 0 {
+		a.Events.append(src.Events.Since(0))
+		a.Events.Seen = src.Events.Seen
+	}
+	repos, discovered := src.Sync.snapshot()
+	a.Sync.mu.Lock()
+	if a.Sync.Repositories == nil {
+		a.Sync.Repositories = make(map[string]*RepoSyncState)
+	}
+	for key, rs := range repos {
+		if _, ok := a.Sync.Repositories[key]; !ok {
+			rs := rs
+			a.Sync.Repositories[key] = &rs
+		}
+	}
+	if a.Sync.Discovered == nil {
+		a.Sync.Discovered = discovered
+	}
+	a.Sync.mu.Unlock()
+	return
+}
+
+func (a *Archive) ReportIssues(labels []string) ([]Issue, error) {
+	return a.storage.ReportIssues(a, labels)
+}
+
+func (a *Archive) Close() error {
+	return a.storage.Close()
+}
+
+// writeZip creates the zip file fp with the files write adds, and syncs it.
+func writeZip(fp string, write func(zw *zip.Writer) error) error {
+	zipFile, err := os.Create(fp)
+	if err != nil {
+		return err
+	}
+	defer zipFile.Close()
+	zipFileWriter := zip.NewWriter(zipFile)
+	if err := write(zipFileWriter); err != nil {
+		return err
+	}
+	if err := zipFileWriter.Close(); err != nil {
+		return err
+	}
+	if err := zipFile.Sync(); err != nil {
+		return err
+	}
+	return zipFile.Close()
+}
+
+func writeZipFile(zw *zip.Writer, name string, content []byte) error {
+	fileWriter, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = fileWriter.Write(content)
+	return err
+}
+
+// isShard tells whether name is one of the monthly NDJSON files under dir.
+func isShard(name, dir string) bool {
+	return strings.HasPrefix(name, dir+"/") && strings.HasSuffix(name, ".ndjson")
+}
+
+// writeShards writes n nodes into zw as NDJSON, a line per node and a file
+// per month of their created time, like issues/2021-06.ndjson. A node never
+// changes its shard, and the nodes keep their order within one. The lines of
+// kept are written as they are after the nodes of their shard.
+func writeShards(zw *zip.Writer, dir string, n int, created func(i int) time.Time, node func(i int) interface{}, kept map[string][][]byte) error {
+	shards := make(map[string][]int)
+	for i := 0; i < n; i++ {
+		name := path.Join(dir, created(i).UTC().Format("2006-01")+".ndjson")
+		shards[name] = append(shards[name], i)
+	}
+	for name := range kept {
+		if _, ok := shards[name]; !ok {
+			shards[name] = nil
+		}
+	}
+	names := make([]string, 0, len(shards))
+	for name := range shards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		for _, i := range shards[name] {
+			if err := enc.Encode(node(i)); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+		for _, line := range kept[name] {
+			bw.Write(line)
+			bw.WriteByte('\n')
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// brokenShard is the shard keeping the nodes of the issues.json or prs.json
+// of an older archive that don't decode.
+const brokenShard = "broken.ndjson"
+
+// brokenLines returns the nodes of kind that didn't decode by the shard of
+// dir they were read from, as lines to write back unchanged. Saving an
+// archive doesn't drop what it couldn't read, a repair may still refetch it.
+func brokenLines(broken []brokenNode, kind, dir string) map[string][][]byte {
+	lines := make(map[string][][]byte)
+	for _, b := range broken {
+		if b.kind != kind || b.data == nil {
+			continue
+		}
+		if i := strings.LastIndexByte(b.where, ':'); i > 0 && isShard(b.where[:i], dir) {
+			name := b.where[:i]
+			lines[name] = append(lines[name], bytes.TrimSpace(b.data))
+			continue
+		}
+		// an element of the JSON array decodes as JSON, it only has to fit a line
+		var line bytes.Buffer
+		if err := json.Compact(&line, b.data); err != nil {
+			line.Reset()
+			line.Write(bytes.TrimSpace(b.data))
+		}
+		name := path.Join(dir, brokenShard)
+		lines[name] = append(lines[name], line.Bytes())
+	}
+	return lines
+}
+
+// decodeNodes reads the nodes of r one at a time and hands them to decode
+// along with where they are, like issues/2021-06.ndjson:12. r is an NDJSON
+// shard, or the JSON array of issues.json and prs.json the archives were
+// kept in before the shards, which is streamed element by element as well.
+func decodeNodes(r io.Reader, where string, ndjson bool, decode func(data []byte, where string)) error {
+	if !ndjson {
+		dec := json.NewDecoder(r)
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+		for i := 0; dec.More(); i++ {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return err
+			}
+			decode(raw, fmt.Sprintf("%s[%d]", where, i))
+		}
+		_, err := dec.Token()
+		return err
+	}
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(data)) != 0 {
+			decode(data, fmt.Sprintf("%s:%d", where, line))
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
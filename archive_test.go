@@ -0,0 +1,140 @@
+package main
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/shurcooL/githubv4"
+)
+
+func zipNames(t *testing.T, fp string) []string {
+	t.Helper()
+	r, err := zip.OpenReader(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestArchiveShards(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "raw.zip")
+	a := NewArchive(&zipStorage{Path: fp})
+	issue := IssueNode{ID: "I_1", Number: 1, State: githubv4.IssueStateOpen}
+	issue.CreatedAt = githubv4.DateTime{Time: time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC)}
+	issue.UpdatedAt = githubv4.DateTime{Time: time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)}
+	a.Issues.Add([]IssueNode{issue})
+	issue.State = githubv4.IssueStateClosed
+	issue.UpdatedAt = githubv4.DateTime{Time: time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)}
+	issue.ClosedAt = issue.UpdatedAt
+	a.Issues.Add([]IssueNode{issue})
+	a.Events.Seen = 1
+	if err := a.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"events/" + time.Now().UTC().Format("2006-01") + ".ndjson", "history/2022-02.ndjson", "issues/2022-02.ndjson", "seen.json", "sync.json"}
+	if got := zipNames(t, fp); !equalStrings(got, want) {
+		t.Errorf("archive files %v, want %v", got, want)
+	}
+
+	b := NewArchive(&zipStorage{Path: fp})
+	if err := b.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(b.Issues.History("I_1")); n != 2 {
+		t.Errorf("%d versions of I_1 loaded, want 2", n)
+	}
+	events := b.Events.Since(0)
+	if len(events) != 2 || events[0].Type != EventIssueOpened || events[1].Type != EventIssueClosed {
+		t.Errorf("events loaded %s, want the issue opened and closed", formatChanges(events))
+	}
+	if b.Events.Seen != 1 {
+		t.Errorf("last change listed %d, want 1", b.Events.Seen)
+	}
+	// loading again doesn't take the events twice
+	if err := b.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(b.Events.Since(0)); n != 2 {
+		t.Errorf("%d events after loading again, want 2", n)
+	}
+}
+
+func TestArchiveLegacyFiles(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "raw.zip")
+	err := writeZip(fp, func(zw *zip.Writer) error {
+		files := map[string]string{
+			archiveIssuesPath:  `[{"id": "I_1", "number": 1, "state": "OPEN", "createdAt": "2022-02-01T00:00:00Z", "updatedAt": "2022-03-01T00:00:00Z"}]`,
+			archiveHistoryPath: `{"I_1": [{"UpdatedAt": "2022-03-01T00:00:00Z", "State": "OPEN"}]}`,
+			archiveEventsPath:  `{"Events": [{"Seq": 1, "Type": "issue_opened", "Number": 1}, {"Seq": 2, "Type": "label_added", "Number": 1}], "Seen": 1}`,
+		}
+		for name, content := range files {
+			if err := writeZipFile(zw, name, []byte(content)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewArchive(&zipStorage{Path: fp})
+	if err := a.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(a.Issues.History("I_1")); n != 1 {
+		t.Errorf("%d versions of I_1 loaded, want 1", n)
+	}
+	if events := a.Events.Since(a.Events.Seen); len(events) != 1 || events[0].Seq != 2 {
+		t.Errorf("events after the last listed %s, want the second one", formatChanges(events))
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestArchiveCheckpoint(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "raw.zip")
+	a := NewArchive(&zipStorage{Path: fp})
+	for i := 1; i < checkpointPages; i++ {
+		if err := a.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(fp); !os.IsNotExist(err) {
+		t.Fatalf("archive written after %d pages: %v", checkpointPages-1, err)
+	}
+	if err := a.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(fp)
+	if err != nil {
+		t.Fatalf("archive not written after %d pages: %v", checkpointPages, err)
+	}
+	// the count starts over after a save
+	if err := a.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := os.Stat(fp); err != nil || !again.ModTime().Equal(info.ModTime()) {
+		t.Errorf("archive written again on the next page: %v", err)
+	}
+}
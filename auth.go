@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// appTokenSource issues installation tokens of a GitHub App, each one is valid
+// for an hour and is reissued by oauth2.ReuseTokenSource once expired.
+type appTokenSource struct {
+	appID          int64
+	installationID int64
+	key            *rsa.PrivateKey
+}
+
+func newAppTokenSource(app *AppConfig) (oauth2.TokenSource, error) {
+	data, err := ioutil.ReadFile(app.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("private key %s: %v", app.PrivateKey, err)
+	}
+	src := &appTokenSource{appID: app.ID, installationID: app.InstallationID, key: key}
+	return oauth2.ReuseTokenSource(nil, src), nil
+}
+
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// jwt signs the short lived token authenticating as the app itself.
+func (s *appTokenSource) jwt(now time.Time) (string, error) {
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		// backdated against clock drift, GitHub takes 10 minutes at most
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": strconv.FormatInt(s.appID, 10),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+func (s *appTokenSource) Token() (*oauth2.Token, error) {
+	jwt, err := s.jwt(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	url := fmt.Sprintf("%s/app/installations/%d/access_tokens", config.GitHub.API, s.installationID)
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("installation token of app %d: %s: %s", s.appID, resp.Status, body)
+	}
+	var token struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, err
+	}
+	log.Printf("issued installation token of app %d expiring at %s", s.appID, token.ExpiresAt.Format(time.RFC3339))
+	// renewed a minute early so a query never goes out with an expired token
+	return &oauth2.Token{AccessToken: token.Token, TokenType: "Bearer", Expiry: token.ExpiresAt.Add(-time.Minute)}, nil
+}
+
+// pooledToken is a credential of the pool along with the rate limit GitHub
+// reported for it.
+type pooledToken struct {
+	name      string
+	src       oauth2.TokenSource
+	remaining int
+	resetAt   time.Time
+}
+
+// budget is the remaining rate limit of t, a token never used or past its
+// reset counts as a full one.
+func (t *pooledToken) budget(now time.Time) int {
+	if t.remaining < 0 || now.After(t.resetAt) {
+		return math.MaxInt32
+	}
+	return t.remaining
+}
+
+// tokenPool authenticates the requests with one of several credentials, it
+// sticks to a token until it runs low and then switches to the one with the
+// most budget left.
+type tokenPool struct {
+	next http.RoundTripper
+
+	mu      sync.Mutex
+	tokens  []*pooledToken
+	current int
+}
+
+// newTokenPool collects the configured GitHub App installation and the
+// personal tokens in $GITHUB_TOKEN and the comma separated $GITHUB_TOKENS.
+func newTokenPool() (*tokenPool, error) {
+	p := &tokenPool{next: http.DefaultTransport}
+	if app := config.Auth.App; app != nil {
+		src, err := newAppTokenSource(app)
+		if err != nil {
+			return nil, err
+		}
+		p.add(fmt.Sprintf("app installation %d", app.InstallationID), src)
+	}
+	if gt := os.Getenv("GITHUB_TOKEN"); gt != "" {
+		p.add("GITHUB_TOKEN", oauth2.StaticTokenSource(&oauth2.Token{AccessToken: gt}))
+	}
+	for i, gt := range strings.Split(os.Getenv("GITHUB_TOKENS"), ",") {
+		if gt = strings.TrimSpace(gt); gt != "" {
+			p.add(fmt.Sprintf("GITHUB_TOKENS[%d]", i), oauth2.StaticTokenSource(&oauth2.Token{AccessToken: gt}))
+		}
+	}
+	if len(p.tokens) == 0 {
+		return nil, errors.New("no GitHub App configured nor GITHUB_TOKEN or GITHUB_TOKENS found in env")
+	}
+	log.Printf("authenticate with %d credentials", len(p.tokens))
+	return p, nil
+}
+
+func (p *tokenPool) add(name string, src oauth2.TokenSource) {
+	p.tokens = append(p.tokens, &pooledToken{name: name, src: src, remaining: -1})
+}
+
+// pick returns the token to send the next request with.
+func (p *tokenPool) pick() *pooledToken {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if p.tokens[p.current].budget(now) >= config.RateLimit.MinRemaining {
+		return p.tokens[p.current]
+	}
+	best := p.current
+	for i, t := range p.tokens {
+		if t.budget(now) > p.tokens[best].budget(now) {
+			best = i
+		}
+	}
+	if best != p.current {
+		log.Printf("%s is down to %d points of rate limit, switch to %s", p.tokens[p.current].name, p.tokens[p.current].remaining, p.tokens[best].name)
+		p.current = best
+	}
+	return p.tokens[best]
+}
+
+func (p *tokenPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	t := p.pick()
+	token, err := t.src.Token()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", t.name, err)
+	}
+	req = req.Clone(req.Context())
+	token.SetAuthHeader(req)
+	resp, err := p.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	remaining, err1 := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	reset, err2 := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err1 == nil && err2 == nil {
+		p.mu.Lock()
+		t.remaining = remaining
+		t.resetAt = time.Unix(reset, 0)
+		p.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// Budget returns the rate limit left on the best token of the pool, -1 if one
+// of them is unused or reset. Once all of them run low it tells when the first
+// one resets.
+func (p *tokenPool) Budget() (remaining int, resetAt time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	remaining = 0
+	for _, t := range p.tokens {
+		b := t.budget(now)
+		if b == math.MaxInt32 {
+			return -1, time.Time{}
+		}
+		if b > remaining {
+			remaining = b
+		}
+		if resetAt.IsZero() || t.resetAt.Before(resetAt) {
+			resetAt = t.resetAt
+		}
+	}
+	return
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shurcooL/githubv4"
+)
+
+const checkpointRange = "range"
+
+// BackfillStats counts what a backfill fetched of a repository and how it
+// changed the archive.
+type BackfillStats struct {
+	Issues       BackfillCount
+	PullRequests BackfillCount
+}
+
+type BackfillCount struct {
+	Fetched int
+	Added   int
+	Updated int
+}
+
+func (c *BackfillCount) add(fetched, added, updated int) {
+	c.Fetched += fetched
+	c.Added += added
+	c.Updated += updated
+}
+
+// parseBackfillTime accepts a date like 2021-06-01 or an RFC3339 time.
+func parseBackfillTime(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("bad time %q, want a date like 2006-01-02 or an RFC3339 time", s)
+	}
+	return t, nil
+}
+
+// inWindow tells whether t is in [since, until).
+func inWindow(t, since, until time.Time) bool {
+	return !t.Before(since) && t.Before(until)
+}
+
+// backfill fetches the issues and pull requests of repos updated in [since,
+// until), whatever was synced before. labels, if given, replaces the issue
+// labels of every repository. Like update, the archive is saved after every
+// page and an interrupted backfill of the same window resumes where it
+// stopped.
+func backfill(a *Archive, repos []RepositoryConfig, labels []string, since, until time.Time) (map[string]*BackfillStats, error) {
+	ti, tpr, st := a.Issues, a.PullRequests, a.Sync
+	checkpoint := a.Checkpoint
+	window := since.UTC().Format(time.RFC3339) + "/" + until.UTC().Format(time.RFC3339)
+
+	var mu sync.Mutex
+	stats := make(map[string]*BackfillStats)
+	p := newPool(config.Concurrency)
+	for _, repo := range repos {
+		repo := repo
+		if labels != nil {
+			repo.Labels = labels
+		}
+		rs := st.Repo(repo, ti, tpr)
+		s := &BackfillStats{}
+		stats[repo.String()] = s
+
+		issuesKind := checkpointRange + "/" + checkpointIssues + "/" + window
+		p.Go(func() error {
+			cp := st.checkpoint(repo, rs, issuesKind, since, until, true)
+			_, err := getIssuesByTimeRange(repo.Owner, repo.Name, repo.Labels, cp.From, cp.To, config.Batch.Issues, -1, cp.cursor(), func(page []IssueNode, cursor githubv4.String) error {
+				issues := make([]IssueNode, 0, len(page))
+				for _, issue := range page {
+					if inWindow(issue.UpdatedAt.Time, since, until) {
+						issues = append(issues, issue)
+					}
+				}
+				added, updated := ti.merge(issues, cp.Past)
+				mu.Lock()
+				s.Issues.add(len(issues), added, updated)
+				mu.Unlock()
+				st.advance(cp, cursor)
+				return checkpoint()
+			})
+			if err != nil {
+				log.Println("failed to backfill issues of", repo, err)
+				return err
+			}
+			st.move(rs, func(rs *RepoSyncState) {
+				// the window joins the tracked history, so extending goes on from
+				// its start
+				if since.Before(rs.IssuesFrom) && !until.Before(rs.IssuesFrom) {
+					rs.IssuesFrom = since
+				}
+			})
+			st.done(rs, issuesKind)
+			return a.Save()
+		})
+
+		prsKind := checkpointRange + "/" + checkpointPullRequests + "/" + window
+		p.Go(func() error {
+			cp := st.checkpoint(repo, rs, prsKind, since, until, true)
+			err := backfillPullRequests(repo, st, cp, checkpoint, func(page []PullRequest) {
+				prs := make([]PullRequest, 0, len(page))
+				for _, pr := range page {
+					if inWindow(pr.UpdatedAt.Time, since, until) {
+						prs = append(prs, pr)
+					}
+				}
+				added, updated := tpr.merge(prs, cp.Past)
+				mu.Lock()
+				s.PullRequests.add(len(prs), added, updated)
+				mu.Unlock()
+			})
+			if err != nil {
+				log.Println("failed to backfill prs of", repo, err)
+				return err
+			}
+			st.done(rs, prsKind)
+			return a.Save()
+		})
+	}
+	err := p.Wait()
+	return stats, err
+}
+
+// backfillPullRequests fetches the pull requests of repo updated in the window
+// of cp and hands every page to add. A part of the window matching more than
+// the search serves is halved until it fits, the start of cp only moves past
+// a part once it is fetched whole, so an interrupted backfill resumes within
+// the part it stopped in.
+func backfillPullRequests(repo RepositoryConfig, st *SyncState, cp *Checkpoint, checkpoint func() error, add func(page []PullRequest)) error {
+	for cp.From.Before(cp.To) {
+		end := cp.To
+		if cp.Part != nil {
+			end = *cp.Part
+		}
+		_, err := getPullRequestsByTimeRange(repo.Owner, repo.Name, cp.From, end, config.Batch.PullRequests, cp.cursor(), func(page []PullRequest, cursor githubv4.String) error {
+			add(page)
+			st.advance(cp, cursor)
+			return checkpoint()
+		})
+		if err == errTooManyResults {
+			mid := cp.From.Add(end.Sub(cp.From) / 2).Truncate(time.Second)
+			log.Printf("split the prs of %s from %s to %s at %s", repo, cp.From.Format(time.RFC3339), end.Format(time.RFC3339), mid.Format(time.RFC3339))
+			st.split(cp, mid)
+		} else if err != nil {
+			return err
+		} else {
+			st.passPart(cp)
+		}
+		if err := checkpoint(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatBackfillStats renders the stats as a table, one repository per row.
+func formatBackfillStats(stats map[string]*BackfillStats) string {
+	repos := make([]string, 0, len(stats))
+	for repo := range stats {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-30s %28s %28s\n", "repository", "issues fetched/added/updated", "prs fetched/added/updated")
+	var total BackfillStats
+	row := func(name string, s *BackfillStats) {
+		fmt.Fprintf(&b, "%-30s %28s %28s\n", name,
+			fmt.Sprintf("%d/%d/%d", s.Issues.Fetched, s.Issues.Added, s.Issues.Updated),
+			fmt.Sprintf("%d/%d/%d", s.PullRequests.Fetched, s.PullRequests.Added, s.PullRequests.Updated))
+	}
+	for _, repo := range repos {
+		s := stats[repo]
+		row(repo, s)
+		total.Issues.add(s.Issues.Fetched, s.Issues.Added, s.Issues.Updated)
+		total.PullRequests.add(s.PullRequests.Fetched, s.PullRequests.Added, s.PullRequests.Updated)
+	}
+	row("total", &total)
+	return b.String()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// searchFixture answers the search of the prs of pingcap/tidb updated from
+// from to to with count matches and the given prs.
+func searchFixture(from, to string, count int, prs ...string) FakeGitHubFixture {
+	edges := "[]"
+	if len(prs) != 0 {
+		edges = ""
+		for i, pr := range prs {
+			if i != 0 {
+				edges += ","
+			}
+			edges += fmt.Sprintf(`{"cursor": %q, "node": %s}`, "c"+from+pr, pr)
+		}
+		edges = "[" + edges + "]"
+	}
+	return FakeGitHubFixture{
+		Query: "search(",
+		Variables: map[string]interface{}{
+			"query": fmt.Sprintf("repo:pingcap/tidb is:pr updated:%s..%s sort:updated-asc", from, to),
+		},
+		Data: json.RawMessage(fmt.Sprintf(`{"search": {"issueCount": %d, "edges": %s}}`, count, edges)),
+	}
+}
+
+func testPR(number int, updated string) string {
+	return fmt.Sprintf(`{"id": "PR_%d", "number": %d, "state": "MERGED", "updatedAt": %q, "createdAt": %q,
+		"repository": {"name": "tidb", "owner": {"login": "pingcap"}}, "timelineItems": {"edges": []}}`, number, number, updated, updated)
+}
+
+func TestBackfillSplitsWindow(t *testing.T) {
+	fake := NewFakeGitHub([]FakeGitHubFixture{
+		{Query: "issues(", Data: json.RawMessage(`{"repository": {"issues": {"edges": []}}}`)},
+		// the window matches more than the search serves, its halves don't
+		searchFixture("2022-03-01T00:00:00Z", "2022-03-05T00:00:00Z", 1500),
+		searchFixture("2022-03-01T00:00:00Z", "2022-03-03T00:00:00Z", 1, testPR(102, "2022-03-02T00:00:00Z")),
+		searchFixture("2022-03-03T00:00:00Z", "2022-03-05T00:00:00Z", 1, testPR(103, "2022-03-04T00:00:00Z")),
+	})
+	defer fake.Close()
+	savedConfig, savedClient := config, client
+	defer func() { config, client = savedConfig, savedClient }()
+	config = defaultConfig()
+	client = fake.Client()
+
+	a := NewArchive(&zipStorage{Path: filepath.Join(t.TempDir(), "raw.zip")})
+	since := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2022, 3, 5, 0, 0, 0, 0, time.UTC)
+	stats, err := backfill(a, config.Repositories, nil, since, until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, missed := fake.Stats(); missed != 0 {
+		t.Errorf("%d queries without fixture", missed)
+	}
+	if got := prNumbers(a.PullRequests); !equalInts(got, []int{102, 103}) {
+		t.Errorf("backfilled prs %v, want [102 103] from both halves", got)
+	}
+	if s := stats["pingcap/tidb"]; s == nil || s.PullRequests.Added != 2 {
+		t.Errorf("backfill stats %+v, want 2 prs added", s)
+	}
+	if cps := a.Sync.Repositories["pingcap/tidb"].Checkpoints; len(cps) != 0 {
+		t.Errorf("checkpoints %v left after the backfill", cps)
+	}
+	if events := a.Events.Since(0); len(events) != 0 {
+		t.Errorf("backfill logged %s", formatChanges(events))
+	}
+}
+
+func TestBackfillResumesPart(t *testing.T) {
+	// a backfill stopped within the second half of its window
+	part := time.Date(2022, 3, 5, 0, 0, 0, 0, time.UTC)
+	cp := &Checkpoint{
+		From: time.Date(2022, 3, 3, 0, 0, 0, 0, time.UTC),
+		To:   time.Date(2022, 3, 9, 0, 0, 0, 0, time.UTC),
+		Part: &part,
+	}
+	fake := NewFakeGitHub([]FakeGitHubFixture{
+		searchFixture("2022-03-03T00:00:00Z", "2022-03-05T00:00:00Z", 1, testPR(103, "2022-03-04T00:00:00Z")),
+		searchFixture("2022-03-05T00:00:00Z", "2022-03-09T00:00:00Z", 1, testPR(105, "2022-03-06T00:00:00Z")),
+	})
+	defer fake.Close()
+	savedConfig, savedClient := config, client
+	defer func() { config, client = savedConfig, savedClient }()
+	config = defaultConfig()
+	client = fake.Client()
+
+	var numbers []int
+	st := &SyncState{}
+	err := backfillPullRequests(config.Repositories[0], st, cp, func() error { return nil }, func(page []PullRequest) {
+		for _, pr := range page {
+			numbers = append(numbers, int(pr.Number))
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalInts(numbers, []int{103, 105}) {
+		t.Errorf("fetched prs %v, want [103 105]", numbers)
+	}
+	if !cp.From.Equal(cp.To) || cp.Part != nil {
+		t.Errorf("checkpoint %+v not finished", cp)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lockArchive takes the advisory lock of the archive at fp, kept in fp.lock
+// along with the pid of the holder. A run finding it held waits for the other
+// one to finish, so it loads what that one saved instead of overwriting it.
+func lockArchive(fp string) (*os.File, error) {
+	lockPath := fp + ".lock"
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = flock(f, false)
+	if isLocked(err) {
+		holder, _ := ioutil.ReadFile(lockPath)
+		start := time.Now()
+		log.Printf("%s is locked by pid %s, waiting", fp, strings.TrimSpace(string(holder)))
+		err = flock(f, true)
+		if err == nil {
+			log.Printf("got the lock of %s after %v", fp, time.Now().Sub(start))
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lock %s: %v", lockPath, err)
+	}
+	writeLockHolder(f)
+	return f, nil
+}
+
+// tryLockArchive is lockArchive without the wait, the file is nil when another
+// run holds the lock.
+func tryLockArchive(fp string) (*os.File, error) {
+	lockPath := fp + ".lock"
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = flock(f, false)
+	if isLocked(err) {
+		f.Close()
+		return nil, nil
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lock %s: %v", lockPath, err)
+	}
+	writeLockHolder(f)
+	return f, nil
+}
+
+// writeLockHolder leaves the pid of this run in the lock file for the runs
+// waiting on it.
+func writeLockHolder(f *os.File) {
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+}
+
+// backupPath names the n-th previous archive of fp, 1 being the latest.
+func backupPath(fp string, n int) string {
+	return fmt.Sprintf("%s.%d", fp, n)
+}
+
+// rotateBackups shifts the previous archives of fp by one, dropping the n-th,
+// and keeps fp itself as the first. fp stays in place for the rename that
+// replaces it.
+func rotateBackups(fp string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(fp); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.Remove(backupPath(fp, n)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := n - 1; i >= 1; i-- {
+		if err := os.Rename(backupPath(fp, i), backupPath(fp, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// a hard link costs nothing, a copy does where links aren't supported
+	if err := os.Link(fp, backupPath(fp, 1)); err != nil {
+		if err := copyFile(fp, backupPath(fp, 1)); err != nil {
+			return fmt.Errorf("back up %s: %v", fp, err)
+		}
+	}
+	return nil
+}
+
+// copyFile copies src to dst and syncs it.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// syncDir flushes the directory of fp, so a rename into it survives a crash.
+func syncDir(fp string) error {
+	dir, err := os.Open(filepath.Dir(fp))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// replaceFile renames the written and synced tmp over fp.
+func replaceFile(tmp, fp string) error {
+	if err := os.Rename(tmp, fp); err != nil {
+		return err
+	}
+	if err := syncDir(fp); err != nil {
+		log.Printf("sync the directory of %s: %v", fp, err)
+	}
+	return nil
+}
+
+type archiveBackup struct {
+	N       int
+	Path    string
+	ModTime time.Time
+	Size    int64
+}
+
+// listBackups returns the previous archives of fp kept on disk, latest first.
+func listBackups(fp string) []archiveBackup {
+	var backups []archiveBackup
+	for n := 1; ; n++ {
+		info, err := os.Stat(backupPath(fp, n))
+		if err != nil {
+			return backups
+		}
+		backups = append(backups, archiveBackup{N: n, Path: backupPath(fp, n), ModTime: info.ModTime(), Size: info.Size()})
+	}
+}
+
+func formatBackups(backups []archiveBackup) string {
+	if len(backups) == 0 {
+		return "no backups\n"
+	}
+	var sb strings.Builder
+	for _, b := range backups {
+		fmt.Fprintf(&sb, "%2d  %s  %10d bytes  %s\n", b.N, b.ModTime.Format("2006-01-02 15:04:05"), b.Size, b.Path)
+	}
+	return sb.String()
+}
+
+// restore rolls the archive back to its n-th backup. The archive replaced
+// becomes the first backup in turn, so restoring 1 again undoes it. Without
+// backups kept it would be lost, so restoring is refused.
+func (s *zipStorage) restore(n int) error {
+	if s.Backups <= 0 {
+		return fmt.Errorf("storage.backups is 0, restoring would drop %s without a backup of it", s.Path)
+	}
+	src := backupPath(s.Path, n)
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return fmt.Errorf("backup %s: %v", src, err)
+	}
+	r.Close()
+	tmpFilePath := s.Path + ".tmp"
+	if err := copyFile(src, tmpFilePath); err != nil {
+		return err
+	}
+	if err := rotateBackups(s.Path, s.Backups); err != nil {
+		return err
+	}
+	s.rotated = true
+	if err := replaceFile(tmpFilePath, s.Path); err != nil {
+		return err
+	}
+	log.Printf("restored %s from %s", s.Path, src)
+	return nil
+}
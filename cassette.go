@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Interaction is a GraphQL request and the response GitHub gave to it.
+type Interaction struct {
+	Query     string
+	Variables json.RawMessage `json:",omitempty"`
+	Status    int
+	Response  json.RawMessage
+}
+
+func (i *Interaction) key() string {
+	return i.Query + "\n" + string(i.Variables)
+}
+
+func newInteraction(body []byte) (*Interaction, error) {
+	var in struct {
+		Query     string          `json:"query"`
+		Variables json.RawMessage `json:"variables"`
+	}
+	if err := json.Unmarshal(body, &in); err != nil {
+		return nil, err
+	}
+	return &Interaction{Query: in.Query, Variables: in.Variables}, nil
+}
+
+// recorder is a RoundTripper appending every GraphQL interaction to a
+// cassette file, one JSON object per line. Each line is flushed as soon as the
+// response arrives, so a crashed run leaves a cassette up to the crash.
+type recorder struct {
+	next http.RoundTripper
+
+	mu       sync.Mutex
+	f        *os.File
+	recorded int
+}
+
+func newRecorder(fp string, next http.RoundTripper) (*recorder, error) {
+	f, err := os.Create(fp)
+	if err != nil {
+		return nil, err
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	log.Printf("recording GitHub traffic to %s", fp)
+	return &recorder{next: next, f: f}, nil
+}
+
+func (r *recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	interaction, err := newInteraction(body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+
+	interaction.Status = resp.StatusCode
+	if json.Valid(respBody) {
+		interaction.Response = respBody
+	} else {
+		// keep error pages like a 502 from the load balancer replayable
+		interaction.Response, _ = json.Marshal(string(respBody))
+	}
+	line, err := json.Marshal(interaction)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.f.Write(append(line, '\n')); err != nil {
+		log.Println("failed to record interaction", err)
+	}
+	r.recorded++
+	return resp, nil
+}
+
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	log.Printf("recorded %d interactions to %s", r.recorded, r.f.Name())
+	return r.f.Close()
+}
+
+// replayer is a RoundTripper serving GraphQL requests from a cassette written
+// by recorder, without touching the network. A request gets the first unused
+// interaction with the same query and variables, failing that the first
+// unused one with the same query, because variables like the since of an
+// issue window may be derived from the current time.
+type replayer struct {
+	mu           sync.Mutex
+	interactions []*Interaction
+	used         []bool
+}
+
+func newReplayer(fp string) (*replayer, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := &replayer{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 1<<20), 1<<30)
+	for line := 1; scanner.Scan(); line++ {
+		i := &Interaction{}
+		if err := json.Unmarshal(scanner.Bytes(), i); err != nil {
+			return nil, fmt.Errorf("cassette %s line %d: %v", fp, line, err)
+		}
+		r.interactions = append(r.interactions, i)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	r.used = make([]bool, len(r.interactions))
+	log.Printf("replaying %d interactions from %s", len(r.interactions), fp)
+	return r, nil
+}
+
+func (r *replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	want, err := newInteraction(body)
+	if err != nil {
+		return nil, err
+	}
+	i := r.next(want)
+	if i == nil {
+		return nil, fmt.Errorf("cassette has no interaction left for %s %s", want.Query, want.Variables)
+	}
+	respBody := []byte(i.Response)
+	var text string
+	if json.Unmarshal(i.Response, &text) == nil {
+		respBody = []byte(text)
+	}
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", i.Status, http.StatusText(i.Status)),
+		StatusCode: i.Status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(respBody)),
+		Request:    req,
+	}, nil
+}
+
+func (r *replayer) next(want *Interaction) *Interaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fallback := -1
+	for idx, i := range r.interactions {
+		if r.used[idx] || i.Query != want.Query {
+			continue
+		}
+		if i.key() == want.key() {
+			r.used[idx] = true
+			return i
+		}
+		if fallback < 0 {
+			fallback = idx
+		}
+	}
+	if fallback < 0 {
+		return nil
+	}
+	log.Printf("replaying interaction %d with variables %s for %s", fallback+1, r.interactions[fallback].Variables, want.Variables)
+	r.used[fallback] = true
+	return r.interactions[fallback]
+}
+
+// Remaining returns the number of interactions not replayed yet.
+func (r *replayer) Remaining() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, used := range r.used {
+		if !used {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/shurcooL/githubv4"
+)
+
+// compaction tells what -compact dropped from the archive and the bytes it
+// took before and after.
+type compaction struct {
+	Issues       int
+	PullRequests int
+	Bodies       int
+	Versions     int
+	Events       int
+	Before       int64
+	After        int64
+}
+
+func (c *compaction) String() string {
+	return fmt.Sprintf("dropped %d issues, %d prs, %d issue versions and %d change events, stripped %d bodies, %d bytes reclaimed (%d to %d)",
+		c.Issues, c.PullRequests, c.Versions, c.Events, c.Bodies, c.Before-c.After, c.Before, c.After)
+}
+
+// expired tells whether issue was closed before cutoff, which the retention
+// doesn't keep.
+func expired(issue *IssueNode, cutoff time.Time) bool {
+	return !cutoff.IsZero() && issue.State == githubv4.IssueStateClosed && issue.ClosedAt.Before(cutoff)
+}
+
+// retention returns the issues and pull requests of a the rules of r drop at
+// now. An issue closed before the cutoff goes, the closer of every issue kept
+// stays along with its cherry-picks, and the ones of those in turn, so the
+// closed-by and cherry-pick relations of what's left still resolve. Open pull
+// requests stay as they may close an issue yet.
+func retention(a *Archive, r RetentionConfig, now time.Time) (issues map[githubv4.ID]bool, prs map[githubv4.ID]bool) {
+	ti, tpr := a.Issues, a.PullRequests
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	tpr.mu.Lock()
+	defer tpr.mu.Unlock()
+
+	cutoff := monthsBefore(now, r.ClosedIssueMonths)
+	issues = make(map[githubv4.ID]bool)
+	keep := make(map[githubv4.ID]bool)
+	for i := range ti.issues {
+		issue := &ti.issues[i]
+		if expired(issue, cutoff) {
+			issues[issue.ID] = true
+			continue
+		}
+		if closer := closerOf(issue); closer != nil {
+			keep[closer.ID] = true
+		}
+	}
+	prs = make(map[githubv4.ID]bool)
+	if !r.CloserPRsOnly {
+		return
+	}
+	var queue []githubv4.ID
+	for id := range keep {
+		queue = append(queue, id)
+	}
+	for i := range tpr.prs {
+		if pr := &tpr.prs[i]; pr.State == githubv4.PullRequestStateOpen && !keep[pr.ID] {
+			keep[pr.ID] = true
+			queue = append(queue, pr.ID)
+		}
+	}
+	for len(queue) != 0 {
+		id := queue[0]
+		queue = queue[1:]
+		pr, ok := tpr.byID(id)
+		if !ok {
+			continue
+		}
+		for _, cp := range cherryPicksOf(pr) {
+			if !keep[cp.PR.ID] {
+				keep[cp.PR.ID] = true
+				queue = append(queue, cp.PR.ID)
+			}
+		}
+	}
+	for i := range tpr.prs {
+		if !keep[tpr.prs[i].ID] {
+			prs[tpr.prs[i].ID] = true
+		}
+	}
+	return
+}
+
+// Compact applies the retention rules r to the archive, saves what is left
+// and has the storage delete what was dropped.
+func (a *Archive) Compact(r RetentionConfig, now time.Time) (c compaction, err error) {
+	if c.Before, err = a.storage.Size(); err != nil {
+		return
+	}
+	// a repository without sync state takes its window from the nodes
+	// tracked, pin it down before they go
+	for _, repo := range trackedRepositories(a.Sync) {
+		a.Sync.Repo(repo, a.Issues, a.PullRequests)
+	}
+	dropIssues, dropPRs := retention(a, r, now)
+	issues := a.Issues.drop(dropIssues)
+	prs := a.PullRequests.drop(dropPRs)
+	c.Issues, c.PullRequests = len(issues), len(prs)
+	if r.StripClosedBody {
+		c.Bodies = a.Issues.stripClosedBodies()
+	}
+	if cutoff := monthsBefore(now, r.HistoryMonths); !cutoff.IsZero() {
+		c.Versions = a.Issues.trimHistory(cutoff)
+	}
+	if cutoff := monthsBefore(now, r.EventMonths); !cutoff.IsZero() {
+		c.Events = a.Events.trim(cutoff)
+	}
+	log.Printf("retention drops %d issues, %d prs, %d issue versions and %d change events, strips %d bodies", c.Issues, c.PullRequests, c.Versions, c.Events, c.Bodies)
+	if err = a.Save(); err != nil {
+		return
+	}
+	if err = a.storage.Delete(a, issues, prs); err != nil {
+		return
+	}
+	c.After, err = a.storage.Size()
+	return
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shurcooL/githubv4"
+)
+
+func closedIssue(number int, closed time.Time) IssueNode {
+	issue := IssueNode{ID: githubv4.ID(fmt.Sprint("I_", number)), Number: githubv4.Int(number), State: githubv4.IssueStateClosed}
+	issue.CreatedAt = githubv4.DateTime{Time: closed.AddDate(0, -1, 0)}
+	issue.UpdatedAt = githubv4.DateTime{Time: closed}
+	issue.ClosedAt = githubv4.DateTime{Time: closed}
+	return issue
+}
+
+func TestRetentionOnlyCompacts(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	config = defaultConfig()
+	config.Retention.ClosedIssueMonths = 12
+
+	old := closedIssue(1, time.Now().AddDate(-2, 0, 0))
+	recent := closedIssue(2, time.Now().AddDate(0, -1, 0))
+	a := NewArchive(&zipStorage{Path: filepath.Join(t.TempDir(), "raw.zip")})
+	// a sync takes what it fetches, an old issue may have been reopened
+	if added, _ := a.Issues.Add([]IssueNode{old, recent}); added != 2 {
+		t.Errorf("added %d issues, want both", added)
+	}
+	if err := a.Save(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := a.Compact(config.Retention, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := issueNumbers(a.Issues); c.Issues != 1 || !equalInts(got, []int{2}) {
+		t.Errorf("compaction dropped %d issues leaving %v, want [2]", c.Issues, got)
+	}
+}
+
+func TestCompactTrimsHistoryAndEvents(t *testing.T) {
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	config = defaultConfig()
+
+	now := time.Now()
+	a := NewArchive(&zipStorage{Path: filepath.Join(t.TempDir(), "raw.zip")})
+	issue := IssueNode{ID: "I_1", Number: 1, State: githubv4.IssueStateOpen}
+	issue.CreatedAt = githubv4.DateTime{Time: now.AddDate(-3, 0, 0)}
+	for _, months := range []int{-36, -30, -24, -1} {
+		issue.UpdatedAt = githubv4.DateTime{Time: now.AddDate(0, months, 0)}
+		issue.Assignees.Nodes = []IssueAssignee{{Login: githubv4.String(fmt.Sprint("dev", months))}}
+		a.Issues.Add([]IssueNode{issue})
+	}
+	// the events of the log are the ones below
+	a.Issues.takeEvents()
+	a.Events.append([]ChangeEvent{
+		{Type: EventIssueOpened, RecordedAt: now.AddDate(-2, 0, 0)},
+		{Type: EventAssigneeAdded, RecordedAt: now.AddDate(0, -1, 0)},
+	})
+	if err := a.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := a.Compact(RetentionConfig{HistoryMonths: 12, EventMonths: 12}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the version in effect a year ago stays
+	if c.Versions != 2 || len(a.Issues.History("I_1")) != 2 {
+		t.Errorf("dropped %d versions leaving %v, want the two replaced before the last one", c.Versions, a.Issues.History("I_1"))
+	}
+	events := a.Events.Since(0)
+	if c.Events != 1 || len(events) != 1 || events[0].Type != EventAssigneeAdded {
+		t.Errorf("dropped %d events leaving %s", c.Events, formatChanges(events))
+	}
+	a.Events.append([]ChangeEvent{{Type: EventIssueClosed, RecordedAt: now}})
+	if events := a.Events.Since(0); events[len(events)-1].Seq != 3 {
+		t.Errorf("event after the trim numbered %d, want 3", events[len(events)-1].Seq)
+	}
+}
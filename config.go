@@ -0,0 +1,425 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config declares what the tracker syncs and where it reports to. It is read
+// from a YAML file given by -config or $TRACKER_CONFIG, anything left out
+// falls back to defaultConfig.
+type Config struct {
+	Repositories  []RepositoryConfig   `yaml:"repositories"`
+	Organizations []OrganizationConfig `yaml:"organizations"`
+	Severity      []SeverityConfig     `yaml:"severity"`
+	Batch         BatchConfig          `yaml:"batch"`
+	RateLimit     RateLimitConfig      `yaml:"rateLimit"`
+	// Concurrency bounds the sync windows fetched at the same time as well as
+	// the queries in flight.
+	Concurrency int             `yaml:"concurrency"`
+	Report      ReportConfig    `yaml:"report"`
+	Auth        AuthConfig      `yaml:"auth"`
+	GitHub      GitHubConfig    `yaml:"github"`
+	Storage     StorageConfig   `yaml:"storage"`
+	Retention   RetentionConfig `yaml:"retention"`
+	Releases    ReleasesConfig  `yaml:"releases"`
+}
+
+type RepositoryConfig struct {
+	Owner string `yaml:"owner"`
+	Name  string `yaml:"name"`
+	// Labels filters the issues to be synced, an issue has to carry all of them.
+	Labels []string `yaml:"labels"`
+	// Clone is the path of a local git clone of the repository, the release
+	// tags containing the fixes are looked up there.
+	Clone string `yaml:"clone"`
+}
+
+func (r RepositoryConfig) String() string {
+	return r.Owner + "/" + r.Name
+}
+
+// OrganizationConfig tracks every repository of a GitHub organization that
+// passes the filters, repositories created later are picked up by the next
+// sync.
+type OrganizationConfig struct {
+	Login string `yaml:"login"`
+	// Labels filters the issues to be synced in each discovered repository.
+	Labels []string `yaml:"labels"`
+	// Topics keeps the repositories that have at least one of the topics.
+	Topics []string `yaml:"topics"`
+	// Match is a glob on the repository name, like "ti*".
+	Match           string `yaml:"match"`
+	IncludeArchived bool   `yaml:"includeArchived"`
+	// Clones is a directory holding local clones of the discovered
+	// repositories by name, like /src for /src/tikv.
+	Clones string `yaml:"clones"`
+}
+
+// SeverityConfig maps a label to a severity level, levels are listed from the
+// most severe one.
+type SeverityConfig struct {
+	Name   string  `yaml:"name"`
+	Label  string  `yaml:"label"`
+	Weight float64 `yaml:"weight"`
+}
+
+type BatchConfig struct {
+	Issues       int `yaml:"issues"`
+	PullRequests int `yaml:"pullRequests"`
+	Contributors int `yaml:"contributors"`
+	// Limit caps the number of nodes fetched by a single sync window.
+	Limit int `yaml:"limit"`
+	// Database is the number of issues written to MySQL per transaction.
+	Database int `yaml:"database"`
+}
+
+type RateLimitConfig struct {
+	// MinRemaining is the budget below which fetching waits for the reset.
+	MinRemaining int `yaml:"minRemaining"`
+	// MaxRetries bounds the retries of a query on secondary rate limits and
+	// server errors, MaxBackoff the delay between two of them.
+	MaxRetries int           `yaml:"maxRetries"`
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+}
+
+type ReportConfig struct {
+	Owner  string `yaml:"owner"`
+	Name   string `yaml:"name"`
+	Issue  int    `yaml:"issue"`
+	Title  string `yaml:"title"`
+	Output string `yaml:"output"`
+	// Labels lists the label sets that each get a table in the report.
+	Labels [][]string `yaml:"labels"`
+}
+
+// GitHubConfig points the tracker at github.com or at a GitHub Enterprise
+// Server.
+type GitHubConfig struct {
+	// URL is the web address the issue and pull request links start with.
+	URL string `yaml:"url"`
+	// GraphQL and API are the endpoints of the GraphQL and REST APIs, derived
+	// from URL when left out.
+	GraphQL string `yaml:"graphql"`
+	API     string `yaml:"api"`
+}
+
+// StorageConfig picks where the archive is kept, the MySQL backend connects
+// to the DSN given by -mysql or $MYSQL_URL.
+type StorageConfig struct {
+	// Backend is zip, sqlite or mysql, left out it follows the extension of
+	// Path.
+	Backend string `yaml:"backend"`
+	Path    string `yaml:"path"`
+	// Backups is the number of previous zip archives kept as path.1, path.2
+	// and so on, the latest first. Every run rotates them once.
+	Backups int `yaml:"backups"`
+	// ManualMigrations leaves the schema migrations to -migrate instead of
+	// applying them whenever the storage is opened.
+	ManualMigrations bool `yaml:"manualMigrations"`
+}
+
+// RetentionConfig bounds what -compact keeps of the archive, left out it
+// keeps everything.
+type RetentionConfig struct {
+	// ClosedIssueMonths drops the issues closed longer ago than that.
+	ClosedIssueMonths int `yaml:"closedIssueMonths"`
+	// CloserPRsOnly drops the closed pull requests that neither closed an
+	// issue kept nor are a cherry-pick of one that did.
+	CloserPRsOnly bool `yaml:"closerPRsOnly"`
+	// StripClosedBody empties the body of the closed issues kept.
+	StripClosedBody bool `yaml:"stripClosedBody"`
+	// HistoryMonths drops the versions of the issues replaced longer ago than
+	// that, -as-of can't look back further.
+	HistoryMonths int `yaml:"historyMonths"`
+	// EventMonths drops the change events recorded longer ago than that.
+	EventMonths int `yaml:"eventMonths"`
+}
+
+// monthsBefore returns the cutoff of a rule keeping months up to now, zero
+// for a rule left out.
+func monthsBefore(now time.Time, months int) time.Time {
+	if months <= 0 {
+		return time.Time{}
+	}
+	return now.AddDate(0, -months, 0)
+}
+
+// ReleasesConfig tells the release tags of the repositories with a clone.
+type ReleasesConfig struct {
+	// TagPattern is a glob of the release tags, like v*.
+	TagPattern string `yaml:"tagPattern"`
+	// Cache is the file keeping the tags found to contain each commit, so a
+	// run only checks the commits and the tags new to it.
+	Cache string `yaml:"cache"`
+}
+
+// AuthConfig picks the credentials other than the personal tokens found in
+// $GITHUB_TOKEN and $GITHUB_TOKENS, all of them share the queries.
+type AuthConfig struct {
+	App *AppConfig `yaml:"app"`
+}
+
+// AppConfig authenticates as an installation of a GitHub App, so the quota
+// belongs to the app rather than to someone's account.
+type AppConfig struct {
+	ID             int64 `yaml:"id"`
+	InstallationID int64 `yaml:"installationID"`
+	// PrivateKey is the path of the PEM file generated for the app.
+	PrivateKey string `yaml:"privateKey"`
+}
+
+var config = defaultConfig()
+
+func defaultConfig() *Config {
+	c := &Config{
+		Repositories: []RepositoryConfig{
+			{Owner: "pingcap", Name: "tidb", Labels: []string{"type/bug"}},
+		},
+		Severity: []SeverityConfig{
+			{Name: "critical", Label: "severity/critical", Weight: 10},
+			{Name: "major", Label: "severity/major", Weight: 3},
+			{Name: "moderate", Label: "severity/moderate", Weight: 1},
+			{Name: "minor", Label: "severity/minor", Weight: 0.1},
+		},
+		Batch: BatchConfig{
+			Issues:       20,
+			PullRequests: 20,
+			Contributors: 100,
+			Limit:        500,
+			Database:     100,
+		},
+		RateLimit: RateLimitConfig{
+			MinRemaining: 100,
+			MaxRetries:   6,
+			MaxBackoff:   2 * time.Minute,
+		},
+		Concurrency: 4,
+		GitHub: GitHubConfig{
+			URL: defaultGitHubURL,
+		},
+		Storage: StorageConfig{
+			Path:    "raw.zip",
+			Backups: 3,
+		},
+		Releases: ReleasesConfig{
+			TagPattern: "v*",
+			Cache:      "tags.json",
+		},
+		Report: ReportConfig{
+			Owner:  "pingcap",
+			Name:   "tidb",
+			Issue:  20804,
+			Title:  "Welcome to contribute",
+			Output: "index.md",
+			Labels: [][]string{
+				// {"sig/planner"},
+				// {"sig/execution"},
+				// {"sig/transaction"},
+				// {"sig/DDL"},
+				{"type/bug"},
+			},
+		},
+	}
+	c.GitHub.resolve()
+	return c
+}
+
+// loadConfig reads the config file at fp on top of the defaults, an empty path
+// gives the defaults.
+func loadConfig(fp string) (*Config, error) {
+	c := defaultConfig()
+	if fp == "" {
+		return c, nil
+	}
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	// lists given in the file replace the default ones instead of being merged
+	// element by element
+	c.Repositories = nil
+	c.Severity = nil
+	c.Report.Labels = nil
+	// the endpoints follow the url given in the file unless given as well
+	c.GitHub.GraphQL, c.GitHub.API = "", ""
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, fmt.Errorf("config %s: %v", fp, err)
+	}
+	d := defaultConfig()
+	if c.Repositories == nil && c.Organizations == nil {
+		c.Repositories = d.Repositories
+	}
+	if c.Severity == nil {
+		c.Severity = d.Severity
+	}
+	if c.Report.Labels == nil {
+		c.Report.Labels = d.Report.Labels
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("config %s: %v", fp, err)
+	}
+	c.GitHub.resolve()
+	return c, nil
+}
+
+func (c *Config) Validate() error {
+	if len(c.Repositories) == 0 && len(c.Organizations) == 0 {
+		return fmt.Errorf("no repositories to track")
+	}
+	seen := make(map[string]bool)
+	for i, r := range c.Repositories {
+		if r.Owner == "" || r.Name == "" {
+			return fmt.Errorf("repositories[%d]: both owner and name are required", i)
+		}
+		if strings.Contains(r.Owner, "/") || strings.Contains(r.Name, "/") {
+			return fmt.Errorf("repositories[%d]: owner and name must not contain '/', got %q and %q", i, r.Owner, r.Name)
+		}
+		if seen[r.String()] {
+			return fmt.Errorf("repositories[%d]: %s is listed more than once", i, r)
+		}
+		seen[r.String()] = true
+	}
+	orgs := make(map[string]bool)
+	for i, o := range c.Organizations {
+		if o.Login == "" {
+			return fmt.Errorf("organizations[%d]: login is required", i)
+		}
+		if orgs[o.Login] {
+			return fmt.Errorf("organizations[%d]: %s is listed more than once", i, o.Login)
+		}
+		orgs[o.Login] = true
+		if _, err := path.Match(o.Match, ""); err != nil {
+			return fmt.Errorf("organizations[%d]: bad match pattern %q: %v", i, o.Match, err)
+		}
+	}
+	levels := make(map[string]bool)
+	for i, s := range c.Severity {
+		if s.Name == "" || s.Label == "" {
+			return fmt.Errorf("severity[%d]: both name and label are required", i)
+		}
+		if levels[s.Name] {
+			return fmt.Errorf("severity[%d]: level %q is listed more than once", i, s.Name)
+		}
+		levels[s.Name] = true
+	}
+	b := c.Batch
+	if b.Issues <= 0 || b.PullRequests <= 0 || b.Contributors <= 0 {
+		return fmt.Errorf("batch: page sizes must be positive, got issues=%d pullRequests=%d contributors=%d", b.Issues, b.PullRequests, b.Contributors)
+	}
+	if b.Issues > 100 || b.PullRequests > 100 || b.Contributors > 100 {
+		return fmt.Errorf("batch: GitHub serves at most 100 nodes per page")
+	}
+	if b.Database <= 0 {
+		return fmt.Errorf("batch: database must be positive, got %d", b.Database)
+	}
+	if b.Limit == 0 {
+		return fmt.Errorf("batch: limit must not be 0, use a negative number for no limit")
+	}
+	if c.RateLimit.MinRemaining < 0 || c.RateLimit.MaxRetries < 0 {
+		return fmt.Errorf("rateLimit: minRemaining and maxRetries must not be negative")
+	}
+	if c.RateLimit.MaxBackoff < time.Second {
+		return fmt.Errorf("rateLimit: maxBackoff must be at least 1s, got %v", c.RateLimit.MaxBackoff)
+	}
+	if c.Concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1, got %d", c.Concurrency)
+	}
+	if app := c.Auth.App; app != nil {
+		if app.ID <= 0 || app.InstallationID <= 0 || app.PrivateKey == "" {
+			return fmt.Errorf("auth.app: id, installationID and privateKey are required")
+		}
+	}
+	for _, u := range []string{c.GitHub.URL, c.GitHub.GraphQL, c.GitHub.API} {
+		if u == "" {
+			continue
+		}
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("github: %q is not an http(s) URL", u)
+		}
+	}
+	if c.GitHub.URL == "" {
+		return fmt.Errorf("github: url is required")
+	}
+	switch c.Storage.Backend {
+	case "", storageZip, storageSQLite:
+		if c.Storage.Path == "" {
+			return fmt.Errorf("storage: path is required")
+		}
+	case storageMySQL:
+	default:
+		return fmt.Errorf("storage: backend must be zip, sqlite or mysql, got %q", c.Storage.Backend)
+	}
+	if c.Storage.Backups < 0 {
+		return fmt.Errorf("storage: backups must not be negative")
+	}
+	if c.Releases.TagPattern == "" || c.Releases.Cache == "" {
+		return fmt.Errorf("releases: tagPattern and cache are required")
+	}
+	if c.Retention.ClosedIssueMonths < 0 || c.Retention.HistoryMonths < 0 || c.Retention.EventMonths < 0 {
+		return fmt.Errorf("retention: closedIssueMonths, historyMonths and eventMonths must not be negative")
+	}
+	r := c.Report
+	if r.Owner == "" || r.Name == "" || r.Issue <= 0 {
+		return fmt.Errorf("report: owner, name and issue are required")
+	}
+	return nil
+}
+
+// CloneOf returns the local clone of repo, the one configured for it or the
+// one in the clones directory of its organization if there is one, "" if it
+// has none.
+func (c *Config) CloneOf(repo RepositoryConfig) string {
+	if repo.Clone != "" {
+		return repo.Clone
+	}
+	for _, org := range c.Organizations {
+		if org.Login != repo.Owner || org.Clones == "" {
+			continue
+		}
+		clone := filepath.Join(org.Clones, repo.Name)
+		if info, err := os.Stat(clone); err == nil && info.IsDir() {
+			return clone
+		}
+	}
+	return ""
+}
+
+// SeverityOf returns the most severe level of the given labels, or "" if none
+// of them is a severity label.
+func (c *Config) SeverityOf(labels []string) string {
+	for _, s := range c.Severity {
+		for _, l := range labels {
+			if l == s.Label {
+				return s.Name
+			}
+		}
+	}
+	return ""
+}
+
+// SeverityOrder ranks the severity levels from 1, the most severe one.
+func (c *Config) SeverityOrder() map[string]int {
+	order := make(map[string]int)
+	for i, s := range c.Severity {
+		order[s.Name] = i + 1
+	}
+	return order
+}
+
+func (c *Config) SeverityWeight(level string) float64 {
+	for _, s := range c.Severity {
+		if s.Name == level {
+			return s.Weight
+		}
+	}
+	return 0
+}
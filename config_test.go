@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSeverityOf(t *testing.T) {
+	c := defaultConfig()
+	tests := []struct {
+		labels []string
+		want   string
+	}{
+		{[]string{"type/bug", "severity/major"}, "major"},
+		{[]string{"severity/minor", "severity/critical"}, "critical"},
+		{[]string{"severity/moderate", "type/bug", "severity/major"}, "major"},
+		{[]string{"type/bug"}, ""},
+	}
+	for _, tt := range tests {
+		if got := c.SeverityOf(tt.labels); got != tt.want {
+			t.Errorf("SeverityOf(%v) = %q, want %q", tt.labels, got, tt.want)
+		}
+	}
+}
+
+func TestCloneOf(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "tikv"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	c := defaultConfig()
+	c.Organizations = []OrganizationConfig{{Login: "tikv", Clones: dir}}
+	tests := []struct {
+		repo RepositoryConfig
+		want string
+	}{
+		{RepositoryConfig{Owner: "pingcap", Name: "tidb", Clone: "/src/tidb"}, "/src/tidb"},
+		{RepositoryConfig{Owner: "tikv", Name: "tikv"}, filepath.Join(dir, "tikv")},
+		// discovered but not cloned
+		{RepositoryConfig{Owner: "tikv", Name: "pd"}, ""},
+		{RepositoryConfig{Owner: "pingcap", Name: "tiflow"}, ""},
+	}
+	for _, tt := range tests {
+		if got := c.CloneOf(tt.repo); got != tt.want {
+			t.Errorf("CloneOf(%s) = %q, want %q", tt.repo, got, tt.want)
+		}
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"log"
 	"os"
 	"sort"
-	"strings"
 	"time"
 
 	"github.com/shurcooL/githubv4"
@@ -106,10 +105,11 @@ type IssueNode2 struct {
 
 var pingcapers = []string{"zz-jason", "zhouqiang-cl", "5kbpers", "AndreMouche", "anotherrachel", "AstroProfundis", "BellaXiang", "booooodv", "breeswish", "buggithubs", "CaitinChen", "cfzjywxk", "ChenPeng2013", "Chujie", "CocaLi", "cosven", "csuzhangxc", "cwen0", "cyliu0", "Damon-PingCAP", "dcalvin", "Deardrops", "disksing", "ethercflow", "eurekaka", "francis0407", "g1eny0ung", "GITHUBear", "glorv", "GMHDBJD", "IANTHEREAL", "HunDunDM", "hunterlxt", "husiyu", "iamxy", "innerr", "iosmanthus", "ishiihara", "jackysp", "JaySon-Huang", "kennytm", "kissmydb", "lawyerphx", "leoppro", "lhy1024", "lichunzhu", "lonng", "lysu", "lzmhhh123", "marsishandsome", "meyu44", "Minorli", "NingLin-P", "nolouch", "PiPaSay", "qiuyesuifeng", "qw4990", "ran-huang", "Reminiscent", "sdojjy", "siddontang", "Soline324", "sticnarf", "SunRunAway", "sunzhuohang", "superlzs0476", "sykp241095", "tangenta", "tennix", "tiancaiamao", "together-wang", "toutdesuite", "tshqin", "uglyengineer", "WangXiangUSTC", "wd0517", "Win-Man", "winkyao", "wsabc01", "wshwsh12", "WT-Liu", "xuechunL", "YangKeao", "yikeke", "YiniXu9506", "you06", "youjiali1995", "YuJuncen", "zanmato1984", "zhexuany", "zhongzc", "zyguan", "jebter", "coocood", "imtbkcat", "XuHuaiyu", "fzhedu", "winoros", "crazycs520", "AilinKid", "djshow832", "zimulala", "hanfei1991", "windtalker", "lidezhu", "birdstorm", "solotzg", "MyonKeminta", "nrc", "Connor1996", "brson", "BusyJay", "gengliqi", "overvenus", "hicqu", "Little-Wallace", "yiwu-arbug", "3pointer", "amyangfei", "july2993", "lucklove", "mahjonp", "mapleFU", "shafreeck", "rleungx", "aylei", "DanielZhangQD", "qiffang", "jlerche", "shuijing198799", "weekface", "onlymellb", "LinuxGit", "Yisaer", "cofyc", "baurine", "aytrack", "lilinghai", "ichn-hu", "LittleFall", "leiysky", "andylokandy", "yeya24", "Illyrix", "fewdan", "zhailei9710", "lilin90", "queenypingcap", "WalterWj", "15521174487", "bb7133", "shenli", "dbaoutdo", "huachaohuang", "UncP", "zhangjinpeng1987", "lamxTyler", "liubo0127", "fipped", "wentaoxu", "zhengwanbo", "lhyPingcap", "ciscoxll", "gaohailang", "yanyanqing", "ilovesoup", "dorianzheng", "datahoecn", "UNHNQ", "TomShawn", "xiekeyi98", "chenxiaojing", "ericsyh", "c4pt0r", "pcqz", "Luffbee", "flowbehappy", "ngaut", "hanfei19910905", "sre-bot", "tabokie", "pingcap", "gregwebs", "kolbe", "gingerkidney", "Hoverbear", "Wenting0905", "hashbone", "huangxiuyan", "foreyes", "k-ye", "WenBoYanging", "zyh-hust", "shuke987", "juliezhang1112", "zhenjiaogao", "langyuemeng", "niezefeng", "wowdba", "time-and-fate", "Hexilee", "zjj2wry", "liuzix", "ZenoTan", "ekexium", "nullnotnil", "Rick-lee01", "miaoqingli", "handlerww", "jyz0309", "morgo", "wjhuang2016", "JmPotato", "xuyifangreeneyes", "dyzsr", "xiongjiwei", "bobotu"}
 
-func getContributors() error {
-	owner := "pingcap"
-	name := "tidb"
+func getContributors(repo RepositoryConfig) error {
+	owner := repo.Owner
+	name := repo.Name
 	var query struct {
+		RateLimited
 		Repository struct {
 			Issues struct {
 				Edges []struct {
@@ -121,7 +121,7 @@ func getContributors() error {
 	}
 	cursor := (*githubv4.String)(nil)
 	total := 0
-	labels := []string{"type/bug"}
+	labels := repo.Labels
 	ghLabels := make([]githubv4.String, 0, len(labels))
 	for _, l := range labels {
 		ghLabels = append(ghLabels, githubv4.String(l))
@@ -142,7 +142,7 @@ func getContributors() error {
 		param := map[string]interface{}{
 			"name":   githubv4.String(name),
 			"owner":  githubv4.String(owner),
-			"limit":  githubv4.Int(batchLimit),
+			"limit":  githubv4.Int(config.Batch.Contributors),
 			"cursor": cursor,
 			"labels": ghLabels,
 		}
@@ -173,26 +173,11 @@ func getContributors() error {
 					for i, l := range n.Labels.Nodes {
 						labels[i] = string(l.Name)
 					}
-					severity := "unkown"
-					di := 0.0
-					for _, l := range labels {
-						if strings.HasPrefix(l, "severity/") {
-							severity = l[9:]
-							break
-						}
-					}
-					switch severity {
-					case "critical":
-						di = 10
-					case "major":
-						di = 3
-					case "moderate":
-						di = 1
-					case "minor":
-						di = 0.1
-					default:
-						di = 0
+					severity := config.SeverityOf(labels)
+					if severity == "" {
+						severity = "unkown"
 					}
+					di := config.SeverityWeight(severity)
 					contrib := Contribution{
 						author:    string(pr.Author.Login),
 						issue_url: string(n.Url),
@@ -216,7 +201,7 @@ func getContributors() error {
 			}
 		}
 
-		if cnt != batchLimit {
+		if cnt != config.Batch.Contributors {
 			break
 		}
 		if debug {
@@ -3,7 +3,6 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"log"
 	"time"
 )
 
@@ -27,7 +26,16 @@ type Issue struct {
 	LinkedPRs  []LinkedPR
 }
 
-func (db *DB) GetIssues(state string, labels []string) (result []Issue) {
+// link returns the stored URL of the issue, or builds one on the configured
+// host for rows stored without it.
+func (i *Issue) link() string {
+	if i.Url != "" {
+		return i.Url
+	}
+	return config.GitHub.IssueURL(repoKey(i.Owner, i.Repository), i.Number)
+}
+
+func (db *DB) GetIssues(state string, labels []string) (result []Issue, err error) {
 	args := make([]interface{}, 0, len(labels)+2)
 	filter := ""
 	args = append(args, state)
@@ -43,16 +51,18 @@ func (db *DB) GetIssues(state string, labels []string) (result []Issue) {
 	stmt := fmt.Sprintf("select * from (select i.id, i.owner, i.repository, i.number, i.url, i.title, i.author, i.hint, i.score, i.mentor, count(*) as cnt from issue as i join label as l on i.id = l.issue_id where i.state = ? and (%s) group by i.id order by i.owner, i.repository, i.number desc) s where s.cnt = ?", filter)
 	res, err := db.Query(stmt, args...)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	defer res.Close()
 	var i Issue
 	var tmp int
 	for res.Next() {
 		var hint, score, mentor *string
 		err := res.Scan(&i.ID, &i.Owner, &i.Repository, &i.Number, &i.Url, &i.Title, &i.Author, &hint, &score, &mentor, &tmp)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
+		i.Hint, i.Score, i.Mentor = "", "", ""
 		if hint != nil {
 			i.Hint = *hint
 		}
@@ -64,23 +74,24 @@ func (db *DB) GetIssues(state string, labels []string) (result []Issue) {
 		}
 		result = append(result, i)
 	}
-	res.Close()
-	return result
+	return result, res.Err()
 }
 
-func (db *DB) GetIssueLabelsByID(issueID int) []string {
+func (db *DB) GetIssueLabelsByID(issueID int) ([]string, error) {
 	res, err := db.Query("select name from label where issue_id = ?", issueID)
 	if err != nil {
-		log.Fatal("error query labels", err)
+		return nil, fmt.Errorf("error query labels: %v", err)
 	}
+	defer res.Close()
 	result := make([]string, 0)
 	var label string
 	for res.Next() {
-		res.Scan(&label)
+		if err := res.Scan(&label); err != nil {
+			return nil, err
+		}
 		result = append(result, label)
 	}
-	res.Close()
-	return result
+	return result, res.Err()
 }
 
 type Assignee struct {
@@ -88,18 +99,20 @@ type Assignee struct {
 	CreatedAt time.Time
 }
 
-func (db *DB) GetIssueAssigneesByID(issueID int) (result []Assignee) {
+func (db *DB) GetIssueAssigneesByID(issueID int) (result []Assignee, err error) {
 	res, err := db.Query("select name, created_at from assignee where issue_id = ?", issueID)
 	if err != nil {
-		log.Fatal("error query labels", err)
+		return nil, fmt.Errorf("error query assignees: %v", err)
 	}
+	defer res.Close()
 	var ass Assignee
 	for res.Next() {
-		res.Scan(&ass.Name, &ass.CreatedAt)
+		if err := res.Scan(&ass.Name, &ass.CreatedAt); err != nil {
+			return nil, err
+		}
 		result = append(result, ass)
 	}
-	res.Close()
-	return result
+	return result, res.Err()
 }
 
 type LinkedPR struct {
@@ -112,16 +125,25 @@ type LinkedPR struct {
 	Author     string
 }
 
-func (db *DB) GetIssueLinkedPRsByID(issueID int) (result []LinkedPR) {
+func (pr *LinkedPR) link() string {
+	if pr.Url != "" {
+		return pr.Url
+	}
+	return config.GitHub.IssueURL(repoKey(pr.Owner, pr.Repository), pr.Number)
+}
+
+func (db *DB) GetIssueLinkedPRsByID(issueID int) (result []LinkedPR, err error) {
 	res, err := db.Query("select pr.ID, pr.owner, pr.repository, pr.number, pr.url, pr.title, pr.author from pull_request as pr join close as c on c.pull_request_id = pr.id where c.issue_id = ?", issueID)
 	if err != nil {
-		log.Fatal("error query labels", err)
+		return nil, fmt.Errorf("error query linked prs: %v", err)
 	}
+	defer res.Close()
 	var pr LinkedPR
 	for res.Next() {
-		res.Scan(&pr.ID, &pr.Owner, &pr.Repository, &pr.Number, &pr.Url, &pr.Title, &pr.Author)
+		if err := res.Scan(&pr.ID, &pr.Owner, &pr.Repository, &pr.Number, &pr.Url, &pr.Title, &pr.Author); err != nil {
+			return nil, err
+		}
 		result = append(result, pr)
 	}
-	res.Close()
-	return result
+	return result, res.Err()
 }
@@ -15131,26 +15131,6 @@ INSERT INTO `pull_request` VALUES
 /*!40000 ALTER TABLE `pull_request` ENABLE KEYS */;
 UNLOCK TABLES;
 
---
--- Table structure for table `sdfs`
---
-
-DROP TABLE IF EXISTS `sdfs`;
-/*!40101 SET @saved_cs_client     = @@character_set_client */;
-/*!50503 SET character_set_client = utf8mb4 */;
-CREATE TABLE `sdfs` (
-  `a` int DEFAULT NULL
-) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
-/*!40101 SET character_set_client = @saved_cs_client */;
-
---
--- Dumping data for table `sdfs`
---
-
-LOCK TABLES `sdfs` WRITE;
-/*!40000 ALTER TABLE `sdfs` DISABLE KEYS */;
-/*!40000 ALTER TABLE `sdfs` ENABLE KEYS */;
-UNLOCK TABLES;
 /*!40103 SET TIME_ZONE=@OLD_TIME_ZONE */;
 
 /*!40101 SET SQL_MODE=@OLD_SQL_MODE */;
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"log"
+	"path"
+
+	"github.com/shurcooL/githubv4"
+)
+
+// discoverRepositories lists the repositories of an organization that pass
+// the filters of org.
+func discoverRepositories(org OrganizationConfig) (repos []RepositoryConfig, err error) {
+	var query struct {
+		RateLimited
+		Organization struct {
+			Repositories struct {
+				PageInfo struct {
+					HasNextPage githubv4.Boolean
+					EndCursor   githubv4.String
+				}
+				Nodes []struct {
+					Name             githubv4.String
+					IsArchived       githubv4.Boolean
+					RepositoryTopics struct {
+						Nodes []struct {
+							Topic struct {
+								Name githubv4.String
+							}
+						}
+					} `graphql:"repositoryTopics(first: 20)"`
+				}
+			} `graphql:"repositories(first: $limit, after: $cursor, orderBy: {field: NAME, direction: ASC})"`
+		} `graphql:"organization(login: $login)"`
+	}
+
+	cursor := (*githubv4.String)(nil)
+	total := 0
+	for {
+		param := map[string]interface{}{
+			"login":  githubv4.String(org.Login),
+			"limit":  githubv4.Int(100),
+			"cursor": cursor,
+		}
+		err = client.Query(context.Background(), &query, param)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		for _, node := range query.Organization.Repositories.Nodes {
+			total++
+			if bool(node.IsArchived) && !org.IncludeArchived {
+				continue
+			}
+			if org.Match != "" {
+				if ok, _ := path.Match(org.Match, string(node.Name)); !ok {
+					continue
+				}
+			}
+			if len(org.Topics) != 0 {
+				matched := false
+				for _, t := range node.RepositoryTopics.Nodes {
+					for _, want := range org.Topics {
+						if string(t.Topic.Name) == want {
+							matched = true
+						}
+					}
+				}
+				if !matched {
+					continue
+				}
+			}
+			repos = append(repos, RepositoryConfig{Owner: org.Login, Name: string(node.Name), Labels: org.Labels})
+		}
+		pageInfo := query.Organization.Repositories.PageInfo
+		if !pageInfo.HasNextPage {
+			break
+		}
+		cursor = &pageInfo.EndCursor
+	}
+	log.Printf("discovered %d of %d repositories in %s", len(repos), total, org.Login)
+	return
+}
+
+// discover refreshes the repositories found in the configured organizations.
+// The last successful result is kept in the sync state so a failed discovery
+// doesn't drop repositories from the tracked set.
+func discover(st *SyncState) {
+	if len(config.Organizations) == 0 {
+		st.mu.Lock()
+		st.Discovered = nil
+		st.mu.Unlock()
+		return
+	}
+	var discovered []RepositoryConfig
+	for _, org := range config.Organizations {
+		repos, err := discoverRepositories(org)
+		if err != nil {
+			log.Println("failed to discover repositories of", org.Login, err)
+			return
+		}
+		discovered = append(discovered, repos...)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, repo := range discovered {
+		if _, ok := st.Repositories[repo.String()]; !ok {
+			log.Printf("start tracking discovered repository %s", repo)
+		}
+	}
+	st.Discovered = discovered
+}
+
+// trackedRepositories returns the configured repositories followed by the
+// discovered ones, a repository listed in the config takes precedence.
+func trackedRepositories(st *SyncState) []RepositoryConfig {
+	st.mu.Lock()
+	discovered := append([]RepositoryConfig(nil), st.Discovered...)
+	st.mu.Unlock()
+	repos := make([]RepositoryConfig, 0, len(config.Repositories)+len(discovered))
+	seen := make(map[string]bool)
+	for _, repo := range config.Repositories {
+		seen[repo.String()] = true
+		repos = append(repos, repo)
+	}
+	for _, repo := range discovered {
+		if !seen[repo.String()] {
+			seen[repo.String()] = true
+			repos = append(repos, repo)
+		}
+	}
+	return repos
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shurcooL/githubv4"
+)
+
+const (
+	EventIssueOpened      = "issue_opened"
+	EventIssueClosed      = "issue_closed"
+	EventIssueReopened    = "issue_reopened"
+	EventLabelAdded       = "label_added"
+	EventLabelRemoved     = "label_removed"
+	EventAssigneeAdded    = "assignee_added"
+	EventAssigneeRemoved  = "assignee_removed"
+	EventCloserLinked     = "closer_linked"
+	EventCherryPickLinked = "cherry_pick_linked"
+)
+
+// ChangeEvent is a change the sync noticed between the tracked version of an
+// issue or pull request and the one fetched.
+type ChangeEvent struct {
+	// Seq numbers the events in the order they were recorded, from 1.
+	Seq    int64
+	Type   string
+	Repo   string
+	Number int
+	Title  string
+	// At is when the change happened as far as the node tells, its updated
+	// time unless it has a better one like the closed time.
+	At         time.Time
+	RecordedAt time.Time
+	Label      string `json:",omitempty"`
+	Assignee   string `json:",omitempty"`
+	// PR is the closer or cherry-pick linked, as owner/name#number.
+	PR string `json:",omitempty"`
+	// Reason tells how a cherry-pick was found.
+	Reason string `json:",omitempty"`
+}
+
+func (e *ChangeEvent) String() string {
+	s := fmt.Sprintf("%s %s#%d %s", e.At.Format("2006-01-02 15:04"), e.Repo, e.Number, e.Type)
+	for _, detail := range []string{e.Label, e.Assignee, e.PR} {
+		if detail != "" {
+			s += " " + detail
+		}
+	}
+	if e.Reason != "" {
+		s += " by " + e.Reason
+	}
+	return s + fmt.Sprintf(" (%s)", e.Title)
+}
+
+func nodeRef(key NumberKey) string {
+	return fmt.Sprintf("%s#%d", key.Repo, key.Number)
+}
+
+// diffNames returns the names in b missing from a and the names in a missing
+// from b.
+func diffNames(a, b []string) (added []string, removed []string) {
+	in := func(names []string, name string) bool {
+		for _, n := range names {
+			if n == name {
+				return true
+			}
+		}
+		return false
+	}
+	for _, n := range b {
+		if !in(a, n) {
+			added = append(added, n)
+		}
+	}
+	for _, n := range a {
+		if !in(b, n) {
+			removed = append(removed, n)
+		}
+	}
+	return
+}
+
+// diffIssue returns the events between old and cur, old is nil for an issue
+// not tracked before, which is reported as opened along with its closing if
+// it is closed already.
+func diffIssue(old, cur *IssueNode) []ChangeEvent {
+	now := time.Now()
+	event := func(typ string, at time.Time) ChangeEvent {
+		return ChangeEvent{
+			Type:       typ,
+			Repo:       cur.Repository.Key(),
+			Number:     int(cur.Number),
+			Title:      string(cur.Title),
+			At:         at,
+			RecordedAt: now,
+		}
+	}
+	var events []ChangeEvent
+	closer := closerOf(cur)
+	if old == nil {
+		events = append(events, event(EventIssueOpened, cur.CreatedAt.Time))
+		if cur.State == githubv4.IssueStateClosed {
+			events = append(events, event(EventIssueClosed, cur.ClosedAt.Time))
+		}
+		if closer != nil {
+			e := event(EventCloserLinked, cur.ClosedAt.Time)
+			e.PR = nodeRef(closer.Key())
+			events = append(events, e)
+		}
+		return events
+	}
+
+	at := cur.UpdatedAt.Time
+	if old.State != cur.State {
+		if cur.State == githubv4.IssueStateClosed {
+			events = append(events, event(EventIssueClosed, cur.ClosedAt.Time))
+		} else {
+			events = append(events, event(EventIssueReopened, at))
+		}
+	}
+	added, removed := diffNames(issueLabels(old), issueLabels(cur))
+	for _, l := range added {
+		e := event(EventLabelAdded, at)
+		e.Label = l
+		events = append(events, e)
+	}
+	for _, l := range removed {
+		e := event(EventLabelRemoved, at)
+		e.Label = l
+		events = append(events, e)
+	}
+	added, removed = diffNames(issueVersion(old).Assignees, issueVersion(cur).Assignees)
+	for _, login := range added {
+		e := event(EventAssigneeAdded, at)
+		e.Assignee = login
+		events = append(events, e)
+	}
+	for _, login := range removed {
+		e := event(EventAssigneeRemoved, at)
+		e.Assignee = login
+		events = append(events, e)
+	}
+	if closer != nil {
+		if prev := closerOf(old); prev == nil || prev.ID != closer.ID {
+			e := event(EventCloserLinked, cur.ClosedAt.Time)
+			e.PR = nodeRef(closer.Key())
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// diffPullRequest returns the cherry-picks of cur not linked in old, old is nil
+// for a pull request not tracked before.
+func diffPullRequest(old, cur *PullRequest) []ChangeEvent {
+	var before []string
+	if old != nil {
+		for _, cp := range cherryPicksOf(old) {
+			before = append(before, nodeRef(cp.PR.Key()))
+		}
+	}
+	var after []string
+	reasons := make(map[string]string)
+	for _, cp := range cherryPicksOf(cur) {
+		ref := nodeRef(cp.PR.Key())
+		after = append(after, ref)
+		reasons[ref] = cp.Reason
+	}
+	added, _ := diffNames(before, after)
+	now := time.Now()
+	events := make([]ChangeEvent, 0, len(added))
+	for _, ref := range added {
+		events = append(events, ChangeEvent{
+			Reason:     reasons[ref],
+			Type:       EventCherryPickLinked,
+			Repo:       cur.Repository.Key(),
+			Number:     int(cur.Number),
+			Title:      string(cur.Title),
+			At:         cur.UpdatedAt.Time,
+			RecordedAt: now,
+			PR:         ref,
+		})
+	}
+	return events
+}
+
+// EventLog keeps the change events of the archive in the order recorded.
+type EventLog struct {
+	mu     sync.Mutex
+	Events []ChangeEvent
+	// Seen is the last event listed by -changes, the next run lists the ones
+	// after it.
+	Seen int64
+	// saved counts the leading events already written by the storage.
+	saved int
+}
+
+// append numbers events and adds them to the log.
+func (l *EventLog) append(events []ChangeEvent) {
+	if len(events) == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var seq int64
+	if n := len(l.Events); n != 0 {
+		seq = l.Events[n-1].Seq
+	}
+	for _, e := range events {
+		seq++
+		e.Seq = seq
+		l.Events = append(l.Events, e)
+	}
+}
+
+// unsaved returns the events recorded since the last save.
+func (l *EventLog) unsaved() []ChangeEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]ChangeEvent(nil), l.Events[l.saved:]...)
+}
+
+func (l *EventLog) markSaved(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.saved += n
+}
+
+// trim drops the events recorded before cutoff, it returns how many went.
+// The latest event always stays, the next one is numbered after it.
+func (l *EventLog) trim(cutoff time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := sort.Search(len(l.Events), func(i int) bool { return !l.Events[i].RecordedAt.Before(cutoff) })
+	if i == len(l.Events) && i != 0 {
+		i--
+	}
+	if i > l.saved {
+		i = l.saved
+	}
+	l.Events = append([]ChangeEvent(nil), l.Events[i:]...)
+	l.saved -= i
+	return i
+}
+
+// first returns the number of the oldest event kept, 0 if there is none.
+func (l *EventLog) first() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.Events) == 0 {
+		return 0
+	}
+	return l.Events[0].Seq
+}
+
+// Since returns the events after seq.
+func (l *EventLog) Since(seq int64) []ChangeEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := sort.Search(len(l.Events), func(i int) bool { return l.Events[i].Seq > seq })
+	return append([]ChangeEvent(nil), l.Events[i:]...)
+}
+
+// RecordedSince returns the events recorded at or after t.
+func (l *EventLog) RecordedSince(t time.Time) []ChangeEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var events []ChangeEvent
+	for _, e := range l.Events {
+		if !e.RecordedAt.Before(t) {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// setLoaded takes the events read by a storage, all of them saved.
+func (l *EventLog) setLoaded(events []ChangeEvent, seen int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sort.Slice(events, func(i, j int) bool { return events[i].Seq < events[j].Seq })
+	l.Events = events
+	l.Seen = seen
+	l.saved = len(events)
+	log.Printf("load %d change events", len(events))
+}
+
+// Load reads the events.json of the archives written before the event
+// shards, the storage takes the events read once every file is.
+func (l *EventLog) Load(data []byte) {
+	var stored struct {
+		Events []ChangeEvent
+		Seen   int64
+	}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		log.Println("failed to load change events", err)
+		return
+	}
+	l.Events = append(l.Events, stored.Events...)
+	l.Seen = stored.Seen
+}
+
+// LoadShard reads the events of r, a shard written by Save, a line at a time.
+func (l *EventLog) LoadShard(r io.Reader, where string) error {
+	return decodeNodes(r, where, true, func(data []byte, where string) {
+		var e ChangeEvent
+		if err := json.Unmarshal(data, &e); err != nil {
+			log.Printf("failed to load change event at %s: %v", where, err)
+			return
+		}
+		l.Events = append(l.Events, e)
+	})
+}
+
+// LoadSeen reads the last event listed by -changes, saved by Save.
+func (l *EventLog) LoadSeen(data []byte) {
+	var stored struct {
+		Seen int64
+	}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		log.Println("failed to load the last change listed", err)
+		return
+	}
+	l.Seen = stored.Seen
+}
+
+// Save writes the events into zw, a line per event in the shard of the month
+// it was recorded in, and the last one listed by -changes next to them.
+func (l *EventLog) Save(zw *zip.Writer) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := writeShards(zw, archiveEventsDir, len(l.Events),
+		func(i int) time.Time { return l.Events[i].RecordedAt },
+		func(i int) interface{} { return &l.Events[i] }, nil)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(struct{ Seen int64 }{l.Seen})
+	if err != nil {
+		return err
+	}
+	return writeZipFile(zw, archiveSeenPath, data)
+}
+
+// formatChanges lists events grouped by repository and number, in the order
+// they were recorded within each.
+func formatChanges(events []ChangeEvent) string {
+	sorted := append([]ChangeEvent(nil), events...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.Repo != b.Repo {
+			return a.Repo < b.Repo
+		}
+		return a.Number < b.Number
+	})
+	var sb strings.Builder
+	for i := range sorted {
+		sb.WriteString(sorted[i].String())
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// saveEvents inserts events into the change_events table, the statement works
+// on both SQLite and MySQL.
+func saveEvents(tx *sql.Tx, table string, events []ChangeEvent) error {
+	for i := range events {
+		e := &events[i]
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO "+table+" (seq, type, repo, number, at, recorded_at, data) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			e.Seq, e.Type, e.Repo, e.Number, sqliteTime(e.At), sqliteTime(e.RecordedAt), data)
+		if err != nil {
+			return fmt.Errorf("change event %d: %v", e.Seq, err)
+		}
+	}
+	return nil
+}
+
+// loadEvents reads all of the events in table.
+func loadEvents(db *sql.DB, table string) ([]ChangeEvent, error) {
+	rows, err := db.Query("SELECT data FROM " + table + " ORDER BY seq")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []ChangeEvent
+	for rows.Next() {
+		var data []byte
+		var e ChangeEvent
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &e); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/shurcooL/githubv4"
+)
+
+// FakeGitHubFixture answers the GraphQL requests whose document contains
+// Query and whose variables include all of Variables.
+type FakeGitHubFixture struct {
+	// Query is a part of the GraphQL document, like "issues(" or
+	// "updateIssue(".
+	Query     string
+	Variables map[string]interface{}
+	Data      json.RawMessage
+	Errors    []struct {
+		Message string `json:"message"`
+	} `json:",omitempty"`
+}
+
+// FakeGitHub is a GraphQL endpoint serving fixture data, it lets sync, linking
+// and reporting run offline against known input. Fixtures are tried in order
+// and the first match wins, so pages of a connection are told apart by their
+// cursor variable.
+type FakeGitHub struct {
+	fixtures []FakeGitHubFixture
+	server   *httptest.Server
+
+	mu       sync.Mutex
+	requests int
+	missed   int
+}
+
+func NewFakeGitHub(fixtures []FakeGitHubFixture) *FakeGitHub {
+	f := &FakeGitHub{fixtures: fixtures}
+	f.server = httptest.NewServer(f)
+	return f
+}
+
+// loadFakeGitHub starts a FakeGitHub serving the fixtures listed in the JSON
+// file at fp.
+func loadFakeGitHub(fp string) (*FakeGitHub, error) {
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	var fixtures []FakeGitHubFixture
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		return nil, fmt.Errorf("fixtures %s: %v", fp, err)
+	}
+	log.Printf("serving %d fixtures from %s", len(fixtures), fp)
+	return NewFakeGitHub(fixtures), nil
+}
+
+func (f *FakeGitHub) Client() Fetcher {
+	return githubv4.NewEnterpriseClient(f.server.URL, f.server.Client())
+}
+
+func (f *FakeGitHub) URL() string {
+	return f.server.URL
+}
+
+// Stats returns the number of requests served and of those no fixture matched.
+func (f *FakeGitHub) Stats() (requests, missed int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests, f.missed
+}
+
+func (f *FakeGitHub) Close() {
+	f.server.Close()
+}
+
+func (f *FakeGitHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Query     string
+		Variables map[string]interface{}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fixture := f.match(in.Query, in.Variables)
+
+	f.mu.Lock()
+	f.requests++
+	if fixture == nil {
+		f.missed++
+	}
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if fixture == nil {
+		log.Printf("no fixture for %s %v", in.Query, in.Variables)
+		fmt.Fprintf(w, `{"errors": [{"message": %q}]}`, "no fixture for the query")
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		Data   json.RawMessage `json:"data,omitempty"`
+		Errors interface{}     `json:"errors,omitempty"`
+	}{fixture.Data, fixture.Errors})
+}
+
+func (f *FakeGitHub) match(query string, variables map[string]interface{}) *FakeGitHubFixture {
+	for i := range f.fixtures {
+		fixture := &f.fixtures[i]
+		if !strings.Contains(query, fixture.Query) {
+			continue
+		}
+		matched := true
+		for k, v := range fixture.Variables {
+			if !reflect.DeepEqual(variables[k], v) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return fixture
+		}
+	}
+	return nil
+}
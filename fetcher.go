@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/shurcooL/githubv4"
+)
+
+// Fetcher is everything the tracker asks of the GitHub GraphQL API,
+// *githubv4.Client satisfies it and so does the client of FakeGitHub.
+type Fetcher interface {
+	Query(ctx context.Context, q interface{}, variables map[string]interface{}) error
+	Mutate(ctx context.Context, m interface{}, input githubv4.Input, variables map[string]interface{}) error
+}
+
+var client Fetcher
+
+// newHTTPClient creates an HTTP client authenticated by the token pool, which
+// is returned as well for the fetcher to know the budget left.
+func newHTTPClient() (*http.Client, *tokenPool, error) {
+	pool, err := newTokenPool()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &http.Client{Transport: pool}, pool, nil
+}
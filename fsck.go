@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shurcooL/githubv4"
+)
+
+const (
+	nodeKindIssue       = "issue"
+	nodeKindPullRequest = "pr"
+)
+
+const (
+	fsckUnparsable = "unparsable"
+	fsckDuplicate  = "duplicate"
+	fsckDangling   = "dangling"
+	fsckUntracked  = "untracked repo"
+	fsckTimestamps = "timestamps"
+)
+
+// brokenNode is a stored node that doesn't decode, its id is empty unless
+// the storage keeps it apart or the JSON is good enough to tell it. data is
+// what the zip archive stored, written back as it is until a repair replaces
+// the node.
+type brokenNode struct {
+	kind  string
+	id    string
+	where string
+	data  []byte
+	err   error
+}
+
+func newBrokenNode(kind, where string, data []byte, err error) brokenNode {
+	var head struct {
+		ID string
+	}
+	json.Unmarshal(data, &head)
+	return brokenNode{kind: kind, id: head.ID, where: where, data: data, err: err}
+}
+
+// fsckProblem is something wrong in the archive. ID names the node to refetch
+// to repair it, nil if none would.
+type fsckProblem struct {
+	Check  string
+	Kind   string
+	ID     githubv4.ID
+	Ref    string
+	Detail string
+}
+
+func (p *fsckProblem) String() string {
+	return fmt.Sprintf("%-14s %-5s %-30s %s", p.Check, p.Kind, p.Ref, p.Detail)
+}
+
+func rfc3339(t time.Time) string {
+	return t.Format(time.RFC3339)
+}
+
+// fsck checks the loaded archive a, loadErr is the error a.Load failed with.
+func fsck(a *Archive, loadErr error) (problems []fsckProblem) {
+	if a.partial {
+		problems = append(problems, fsckProblem{Check: fsckUnparsable, Ref: "archive", Detail: loadErr.Error()})
+	}
+	for _, b := range a.broken {
+		p := fsckProblem{Check: fsckUnparsable, Kind: b.kind, Ref: b.where, Detail: b.err.Error()}
+		if b.id != "" {
+			p.ID = githubv4.ID(b.id)
+		}
+		problems = append(problems, p)
+	}
+
+	ti, tpr := a.Issues, a.PullRequests
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	tpr.mu.Lock()
+	defer tpr.mu.Unlock()
+
+	tracked := make(map[string]bool)
+	for _, repo := range trackedRepositories(a.Sync) {
+		tracked[repo.String()] = true
+	}
+
+	ids := make(map[githubv4.ID]int)
+	keys := make(map[NumberKey]githubv4.ID)
+	for i := range ti.issues {
+		issue := &ti.issues[i]
+		ref := nodeRef(issue.Key())
+		problem := func(check, detail string, args ...interface{}) {
+			problems = append(problems, fsckProblem{Check: check, Kind: nodeKindIssue, ID: issue.ID, Ref: ref, Detail: fmt.Sprintf(detail, args...)})
+		}
+		if ids[issue.ID]++; ids[issue.ID] == 2 {
+			problem(fsckDuplicate, "id %v is stored more than once", issue.ID)
+		}
+		if id, ok := keys[issue.Key()]; ok && id != issue.ID {
+			problem(fsckDuplicate, "number taken by %v as well", id)
+		}
+		keys[issue.Key()] = issue.ID
+		if !tracked[issue.Repository.Key()] {
+			problem(fsckUntracked, "%s is neither configured nor discovered", issue.Repository.Key())
+		}
+		created, updated, closed := issue.CreatedAt.Time, issue.UpdatedAt.Time, issue.ClosedAt.Time
+		if updated.Before(created) {
+			problem(fsckTimestamps, "updated at %s before created at %s", rfc3339(updated), rfc3339(created))
+		}
+		if !closed.IsZero() && (closed.Before(created) || closed.After(updated)) {
+			problem(fsckTimestamps, "closed at %s outside of %s to %s", rfc3339(closed), rfc3339(created), rfc3339(updated))
+		}
+		versions := ti.history[issue.ID]
+		for k := 1; k < len(versions); k++ {
+			if !versions[k].UpdatedAt.After(versions[k-1].UpdatedAt) {
+				problem(fsckTimestamps, "history goes back from %s to %s", rfc3339(versions[k-1].UpdatedAt), rfc3339(versions[k].UpdatedAt))
+				break
+			}
+		}
+		if n := len(versions); n != 0 && versions[n-1].UpdatedAt.After(updated) {
+			problem(fsckTimestamps, "history runs to %s past updated at %s", rfc3339(versions[n-1].UpdatedAt), rfc3339(updated))
+		}
+		if closer := closerOf(issue); closer != nil {
+			if _, ok := tpr.idMap[closer.ID]; !ok {
+				problems = append(problems, fsckProblem{Check: fsckDangling, Kind: nodeKindPullRequest, ID: closer.ID, Ref: nodeRef(closer.Key()),
+					Detail: fmt.Sprintf("closer of %s is not tracked", ref)})
+			}
+		}
+	}
+
+	ids = make(map[githubv4.ID]int)
+	keys = make(map[NumberKey]githubv4.ID)
+	for i := range tpr.prs {
+		pr := &tpr.prs[i]
+		ref := nodeRef(pr.Key())
+		problem := func(check, detail string, args ...interface{}) {
+			problems = append(problems, fsckProblem{Check: check, Kind: nodeKindPullRequest, ID: pr.ID, Ref: ref, Detail: fmt.Sprintf(detail, args...)})
+		}
+		if ids[pr.ID]++; ids[pr.ID] == 2 {
+			problem(fsckDuplicate, "id %v is stored more than once", pr.ID)
+		}
+		if id, ok := keys[pr.Key()]; ok && id != pr.ID {
+			problem(fsckDuplicate, "number taken by %v as well", id)
+		}
+		keys[pr.Key()] = pr.ID
+		created, updated, merged := pr.CreatedAt.Time, pr.UpdatedAt.Time, pr.MergedAt.Time
+		if updated.Before(created) {
+			problem(fsckTimestamps, "updated at %s before created at %s", rfc3339(updated), rfc3339(created))
+		}
+		if !merged.IsZero() && (merged.Before(created) || merged.After(updated)) {
+			problem(fsckTimestamps, "merged at %s outside of %s to %s", rfc3339(merged), rfc3339(created), rfc3339(updated))
+		}
+		for _, cp := range cherryPicksOf(pr) {
+			if _, ok := tpr.idMap[cp.PR.ID]; !ok {
+				problems = append(problems, fsckProblem{Check: fsckDangling, Kind: nodeKindPullRequest, ID: cp.PR.ID, Ref: nodeRef(cp.PR.Key()),
+					Detail: fmt.Sprintf("cherry-pick of %s is not tracked", ref)})
+			}
+		}
+	}
+	return problems
+}
+
+// repair drops the duplicates of a and refetches the nodes of problems, the
+// dangling references are fetched and tracked. The broken nodes refetched are
+// no longer kept as stored. The caller saves a, unless it didn't load whole.
+func repair(a *Archive, problems []fsckProblem) (fixed int, failed int) {
+	if n := a.Issues.dedupe() + a.PullRequests.dedupe(); n != 0 {
+		log.Printf("dropped %d duplicate nodes", n)
+	}
+	seen := make(map[githubv4.ID]bool)
+	for _, p := range problems {
+		if p.ID == nil || seen[p.ID] {
+			continue
+		}
+		seen[p.ID] = true
+		var err error
+		switch p.Kind {
+		case nodeKindIssue:
+			var issue IssueNode
+			if issue, err = getIssueByID(p.ID); err == nil {
+				a.Issues.Replace(issue)
+				a.dropBroken(p.ID)
+			}
+		case nodeKindPullRequest:
+			var pr PullRequest
+			if pr, err = getPullRequestByID(p.ID); err == nil {
+				a.PullRequests.Replace(pr)
+				a.dropBroken(p.ID)
+			}
+		}
+		if err != nil {
+			log.Printf("refetch %s %s: %v", p.Kind, p.Ref, err)
+			failed++
+			continue
+		}
+		fixed++
+	}
+	return
+}
+
+// formatFsck summarizes the problems by check and lists them.
+func formatFsck(problems []fsckProblem) string {
+	if len(problems) == 0 {
+		return "no problems found\n"
+	}
+	counts := make(map[string]int)
+	for _, p := range problems {
+		counts[p.Check]++
+	}
+	checks := make([]string, 0, len(counts))
+	for check := range counts {
+		checks = append(checks, check)
+	}
+	sort.Strings(checks)
+	var sb strings.Builder
+	for _, check := range checks {
+		fmt.Fprintf(&sb, "%d %s\n", counts[check], check)
+	}
+	sb.WriteByte('\n')
+	for i := range problems {
+		sb.WriteString(problems[i].String())
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRepairKeepsBrokenNodes(t *testing.T) {
+	fake := NewFakeGitHub([]FakeGitHubFixture{
+		{
+			Query:     "node(",
+			Variables: map[string]interface{}{"id": "I_102"},
+			Data: json.RawMessage(`{"node": {"id": "I_102", "number": 102, "state": "OPEN",
+				"createdAt": "2022-02-01T00:00:00Z", "updatedAt": "2022-02-02T00:00:00Z",
+				"repository": {"name": "tidb", "owner": {"login": "pingcap"}}}}`),
+		},
+	})
+	defer fake.Close()
+	savedConfig, savedClient := config, client
+	defer func() { config, client = savedConfig, savedClient }()
+	config = defaultConfig()
+	client = fake.Client()
+
+	fp := filepath.Join(t.TempDir(), "raw.zip")
+	good := `{"id":"I_101","number":101,"state":"OPEN","createdAt":"2022-02-01T00:00:00Z","updatedAt":"2022-02-01T00:00:00Z","repository":{"name":"tidb","owner":{"login":"pingcap"}}}`
+	// one line tells its id and is refetched, the other is kept as it is
+	refetched := `{"id":"I_102","number":"102"}`
+	garbage := `{"number": 103, "title": "cut off`
+	err := writeZip(fp, func(zw *zip.Writer) error {
+		return writeZipFile(zw, "issues/2022-02.ndjson", []byte(good+"\n"+refetched+"\n"+garbage+"\n"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewArchive(&zipStorage{Path: fp})
+	loadErr := a.Load()
+	if loadErr == nil {
+		t.Fatal("archive with broken nodes loaded")
+	}
+	problems := fsck(a, loadErr)
+	if len(problems) != 2 {
+		t.Fatalf("fsck found %s", formatFsck(problems))
+	}
+	if fixed, failed := repair(a, problems); fixed != 1 || failed != 0 {
+		t.Errorf("repair fixed %d and failed %d, want 1 and 0", fixed, failed)
+	}
+	if err := a.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewArchive(&zipStorage{Path: fp})
+	loadErr = b.Load()
+	if got := issueNumbers(b.Issues); !equalInts(got, []int{101, 102}) {
+		t.Errorf("issues %v after the repair, want [101 102]", got)
+	}
+	if len(b.broken) != 1 || strings.TrimSpace(string(b.broken[0].data)) != garbage {
+		t.Errorf("broken nodes %v after the repair, want the unparsable line kept", b.broken)
+	}
+	if problems := fsck(b, loadErr); len(problems) != 1 || problems[0].ID != nil {
+		t.Errorf("fsck after the repair found %s", formatFsck(problems))
+	}
+}
+
+func TestFsckPartialArchive(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "raw.zip")
+	err := writeZip(fp, func(zw *zip.Writer) error {
+		return writeZipFile(zw, archiveIssuesPath, []byte(`[{"id": "I_101"}, {"id"`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewArchive(&zipStorage{Path: fp})
+	loadErr := a.Load()
+	if loadErr == nil || !a.partial {
+		t.Fatalf("a cut off issues.json loaded whole, %v", loadErr)
+	}
+	problems := fsck(a, loadErr)
+	if len(problems) == 0 || problems[0].Ref != "archive" || problems[0].ID != nil {
+		t.Errorf("fsck found %s, want the archive unparsable", formatFsck(problems))
+	}
+}
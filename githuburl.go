@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const defaultGitHubURL = "https://github.com"
+
+// resolve derives the API endpoints left out of the config from the web URL,
+// github.com serves them from api.github.com and GitHub Enterprise Server
+// under /api of its own host.
+func (c *GitHubConfig) resolve() {
+	c.URL = strings.TrimSuffix(c.URL, "/")
+	dotcom := c.URL == defaultGitHubURL
+	if c.GraphQL == "" {
+		if dotcom {
+			c.GraphQL = "https://api.github.com/graphql"
+		} else {
+			c.GraphQL = c.URL + "/api/graphql"
+		}
+	}
+	if c.API == "" {
+		if dotcom {
+			c.API = "https://api.github.com"
+		} else {
+			c.API = c.URL + "/api/v3"
+		}
+	}
+	c.API = strings.TrimSuffix(c.API, "/")
+}
+
+// IssueURL returns the web address of an issue, GitHub redirects it to the
+// pull request if the number is one.
+func (c *GitHubConfig) IssueURL(repo string, number int) string {
+	return fmt.Sprintf("%s/%s/issues/%d", c.URL, repo, number)
+}
+
+// ParseURL splits a web address of the configured host like
+// https://github.com/pingcap/tidb/issues/1234 or .../pull/1234 into the
+// repository and the number. The number is 0 for the address of a repository.
+func (c *GitHubConfig) ParseURL(s string) (NumberKey, error) {
+	base, err := url.Parse(c.URL)
+	if err != nil {
+		return NumberKey{}, err
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return NumberKey{}, err
+	}
+	if !strings.EqualFold(u.Host, base.Host) {
+		return NumberKey{}, fmt.Errorf("%s is not on %s", s, c.URL)
+	}
+	// GitHub Enterprise Server may be served under a path prefix, whole
+	// segments of it: /ghe/pingcap/tidb is not under /gh
+	p := strings.Trim(u.Path, "/")
+	if prefix := strings.Trim(base.Path, "/"); prefix != "" {
+		if p != prefix && !strings.HasPrefix(p, prefix+"/") {
+			return NumberKey{}, fmt.Errorf("%s is not under %s", s, c.URL)
+		}
+		p = strings.TrimPrefix(p, prefix)
+	}
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return NumberKey{}, fmt.Errorf("%s names no repository", s)
+	}
+	key := NumberKey{Repo: repoKey(parts[0], strings.TrimSuffix(parts[1], ".git"))}
+	if len(parts) == 2 {
+		return key, nil
+	}
+	if len(parts) < 4 || (parts[2] != "issues" && parts[2] != "pull") {
+		return NumberKey{}, fmt.Errorf("%s is neither an issue nor a pull request", s)
+	}
+	key.Number, err = strconv.Atoi(parts[3])
+	if err != nil || key.Number <= 0 {
+		return NumberKey{}, fmt.Errorf("%s has no valid number", s)
+	}
+	return key, nil
+}
+
+// ParseRepository accepts owner/name or a web address in the repository and
+// returns owner/name.
+func (c *GitHubConfig) ParseRepository(s string) (string, error) {
+	if !strings.Contains(s, "://") {
+		parts := strings.Split(s, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return "", fmt.Errorf("%q is neither owner/name nor a URL", s)
+		}
+		return s, nil
+	}
+	key, err := c.ParseURL(s)
+	if err != nil {
+		return "", err
+	}
+	return key.Repo, nil
+}
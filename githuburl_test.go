@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestParseURL(t *testing.T) {
+	cases := []struct {
+		base string
+		url  string
+		want NumberKey
+		err  bool
+	}{
+		{base: defaultGitHubURL, url: "https://github.com/pingcap/tidb/issues/1234", want: NumberKey{Repo: "pingcap/tidb", Number: 1234}},
+		{base: defaultGitHubURL, url: "https://github.com/pingcap/tidb.git", want: NumberKey{Repo: "pingcap/tidb"}},
+		{base: defaultGitHubURL, url: "https://gitlab.com/pingcap/tidb", err: true},
+		{base: "https://git.example.com/gh", url: "https://git.example.com/gh/pingcap/tidb/pull/7", want: NumberKey{Repo: "pingcap/tidb", Number: 7}},
+		// a prefix is matched by whole segments
+		{base: "https://git.example.com/gh", url: "https://git.example.com/ghe/pingcap/tidb/pull/7", err: true},
+		{base: "https://git.example.com/gh", url: "https://git.example.com/gh", err: true},
+	}
+	for _, c := range cases {
+		gh := GitHubConfig{URL: c.base}
+		got, err := gh.ParseURL(c.url)
+		if c.err {
+			if err == nil {
+				t.Errorf("ParseURL(%s) under %s = %v, want an error", c.url, c.base, got)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("ParseURL(%s) under %s = %v, %v, want %v", c.url, c.base, got, err, c.want)
+		}
+	}
+}
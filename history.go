@@ -0,0 +1,375 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/shurcooL/githubv4"
+)
+
+// IssueVersion is the state, labels and assignees of an issue from UpdatedAt
+// on until the next version.
+type IssueVersion struct {
+	UpdatedAt time.Time
+	State     githubv4.IssueState
+	ClosedAt  time.Time `json:",omitempty"`
+	Labels    []string  `json:",omitempty"`
+	Assignees []string  `json:",omitempty"`
+}
+
+func issueVersion(issue *IssueNode) IssueVersion {
+	v := IssueVersion{
+		UpdatedAt: issue.UpdatedAt.Time,
+		State:     issue.State,
+		ClosedAt:  issue.ClosedAt.Time,
+		Labels:    issueLabels(issue),
+	}
+	for _, as := range issue.Assignees.Nodes {
+		v.Assignees = append(v.Assignees, string(as.Login))
+	}
+	return v
+}
+
+// sameState tells whether v and o differ in their time only.
+func (v *IssueVersion) sameState(o *IssueVersion) bool {
+	if v.State != o.State || !v.ClosedAt.Equal(o.ClosedAt) || len(v.Labels) != len(o.Labels) || len(v.Assignees) != len(o.Assignees) {
+		return false
+	}
+	for i := range v.Labels {
+		if v.Labels[i] != o.Labels[i] {
+			return false
+		}
+	}
+	for i := range v.Assignees {
+		if v.Assignees[i] != o.Assignees[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// record adds the version of issue to its history unless a version of the
+// same time is there, or the one before it has the same state. A version
+// older than the latest one, like from a backfill, is put in its place. It
+// tells whether the history changed, ti.mu must be held.
+func (ti *TrackedIssues) record(issue *IssueNode) bool {
+	if ti.history == nil {
+		ti.history = make(map[githubv4.ID][]IssueVersion)
+	}
+	v := issueVersion(issue)
+	versions := ti.history[issue.ID]
+	i := sort.Search(len(versions), func(i int) bool { return !versions[i].UpdatedAt.Before(v.UpdatedAt) })
+	if i < len(versions) && versions[i].UpdatedAt.Equal(v.UpdatedAt) {
+		return false
+	}
+	if i > 0 && versions[i-1].sameState(&v) {
+		return false
+	}
+	versions = append(versions, IssueVersion{})
+	copy(versions[i+1:], versions[i:])
+	versions[i] = v
+	// the next version may now repeat this one
+	if i+1 < len(versions) && versions[i+1].sameState(&v) {
+		versions = append(versions[:i+1], versions[i+2:]...)
+	}
+	ti.history[issue.ID] = versions
+	return true
+}
+
+// History returns the recorded versions of an issue, oldest first.
+func (ti *TrackedIssues) History(id githubv4.ID) []IssueVersion {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	return append([]IssueVersion(nil), ti.history[id]...)
+}
+
+// trimHistory drops the versions of every issue replaced by a newer one
+// before cutoff, the one in effect then stays. It returns how many went.
+func (ti *TrackedIssues) trimHistory(cutoff time.Time) (n int) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	for id, versions := range ti.history {
+		i := sort.Search(len(versions), func(i int) bool { return versions[i].UpdatedAt.After(cutoff) })
+		if i <= 1 {
+			continue
+		}
+		ti.history[id] = append([]IssueVersion(nil), versions[i-1:]...)
+		n += i - 1
+		if _, ok := ti.issuesMap[id]; ok {
+			ti.markDirty(id)
+		}
+	}
+	return
+}
+
+// setHistory replaces the recorded versions of an issue when a storage loads
+// them.
+func (ti *TrackedIssues) setHistory(id githubv4.ID, versions []IssueVersion) {
+	if ti.history == nil {
+		ti.history = make(map[githubv4.ID][]IssueVersion)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].UpdatedAt.Before(versions[j].UpdatedAt) })
+	ti.history[id] = versions
+}
+
+// mergeHistory records the versions of src into ti.
+func (ti *TrackedIssues) mergeHistory(src *TrackedIssues) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	for id, versions := range src.history {
+		i, ok := ti.issuesMap[id]
+		if !ok {
+			continue
+		}
+		for _, v := range versions {
+			node := ti.issues[i]
+			applyVersion(&node, &v, nil)
+			if ti.record(&node) {
+				ti.markDirty(id)
+			}
+		}
+	}
+}
+
+// issueHistory is a line of the history shards, the versions of an issue.
+type issueHistory struct {
+	ID       string
+	Versions []IssueVersion
+}
+
+// LoadHistory reads the history.json of the archives written before the
+// history shards, the versions keyed by node id.
+func (ti *TrackedIssues) LoadHistory(data []byte) {
+	var history map[string][]IssueVersion
+	if err := json.Unmarshal(data, &history); err != nil {
+		log.Println("failed to load issue history", err)
+		return
+	}
+	for id, versions := range history {
+		ti.setHistory(githubv4.ID(id), versions)
+	}
+}
+
+// LoadHistoryShard reads the versions of r, a shard written by SaveHistory, a
+// line at a time.
+func (ti *TrackedIssues) LoadHistoryShard(r io.Reader, where string) error {
+	return decodeNodes(r, where, true, func(data []byte, where string) {
+		var h issueHistory
+		if err := json.Unmarshal(data, &h); err != nil {
+			log.Printf("failed to load issue history at %s: %v", where, err)
+			return
+		}
+		ti.setHistory(githubv4.ID(h.ID), h.Versions)
+	})
+}
+
+// SaveHistory writes the versions of every issue into zw, a line per issue in
+// the shard of the month the issue was created in, or of its first version
+// for an issue no longer tracked.
+func (ti *TrackedIssues) SaveHistory(zw *zip.Writer) error {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ids := make([]githubv4.ID, 0, len(ti.history))
+	for id := range ti.history {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return nodeID(ids[i]) < nodeID(ids[j]) })
+	return writeShards(zw, archiveHistoryDir, len(ids),
+		func(i int) time.Time {
+			if k, ok := ti.issuesMap[ids[i]]; ok {
+				return ti.issues[k].CreatedAt.Time
+			}
+			if versions := ti.history[ids[i]]; len(versions) != 0 {
+				return versions[0].UpdatedAt
+			}
+			return time.Time{}
+		},
+		func(i int) interface{} { return &issueHistory{ID: nodeID(ids[i]), Versions: ti.history[ids[i]]} }, nil)
+}
+
+// versionAt returns the version of an issue in effect at t, nil if t is before
+// the first recorded one.
+func (ti *TrackedIssues) versionAt(id githubv4.ID, t time.Time) *IssueVersion {
+	versions := ti.history[id]
+	i := sort.Search(len(versions), func(i int) bool { return versions[i].UpdatedAt.After(t) })
+	if i == 0 {
+		return nil
+	}
+	return &versions[i-1]
+}
+
+// applyVersion sets the state, labels and assignees of issue to v, the
+// assignees keep their details from cur if they are found there.
+func applyVersion(issue *IssueNode, v *IssueVersion, cur *IssueNode) {
+	issue.UpdatedAt = githubv4.DateTime{Time: v.UpdatedAt}
+	issue.State = v.State
+	issue.ClosedAt = githubv4.DateTime{Time: v.ClosedAt}
+	issue.Labels.Nodes = make([]Label, 0, len(v.Labels))
+	for _, l := range v.Labels {
+		issue.Labels.Nodes = append(issue.Labels.Nodes, Label{Name: githubv4.String(l)})
+	}
+	issue.Assignees.Nodes = make([]IssueAssignee, 0, len(v.Assignees))
+	for _, login := range v.Assignees {
+		as := IssueAssignee{Login: githubv4.String(login)}
+		if cur != nil {
+			for _, c := range cur.Assignees.Nodes {
+				if string(c.Login) == login {
+					as = c
+				}
+			}
+		}
+		issue.Assignees.Nodes = append(issue.Assignees.Nodes, as)
+	}
+}
+
+// timelineItemTime returns when item happened, zero if that isn't known. A
+// cross reference synced before its time was fetched falls back to the
+// creation of the referencing pull request, which it can't precede.
+func timelineItemTime(item *IssueTimelineItem) time.Time {
+	node := &item.Node
+	if t := node.CrossReferencedEvent.CreatedAt.Time; !t.IsZero() {
+		return t
+	}
+	if t := node.ClosedEvent.CreatedAt.Time; !t.IsZero() {
+		return t
+	}
+	return node.CrossReferencedEvent.Source.PullRequest.CreatedAt.Time
+}
+
+// AsOf materializes the tracked issues as they were at t, for the reports to
+// look back at a past day. The issues created after t are left out, and so
+// are the timeline items after t, like the pull requests linked later. An
+// issue tracked only after t changed it the last time is taken as it was
+// first recorded, still open if it was closed after t, as nothing tells its
+// labels and assignees before.
+func (ti *TrackedIssues) AsOf(t time.Time) *TrackedIssues {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	out := &TrackedIssues{}
+	for k := range ti.issues {
+		cur := &ti.issues[k]
+		if cur.CreatedAt.After(t) {
+			continue
+		}
+		issue := *cur
+		v := ti.versionAt(cur.ID, t)
+		if v == nil {
+			if versions := ti.history[cur.ID]; len(versions) != 0 {
+				v = &versions[0]
+			}
+		}
+		if v != nil {
+			applyVersion(&issue, v, cur)
+		}
+		if !issue.ClosedAt.IsZero() && issue.ClosedAt.After(t) {
+			issue.State = githubv4.IssueStateOpen
+			issue.ClosedAt = githubv4.DateTime{}
+		}
+		issue.TimelineItems.Edges = nil
+		for _, item := range cur.TimelineItems.Edges {
+			if !timelineItemTime(&item).After(t) {
+				issue.TimelineItems.Edges = append(issue.TimelineItems.Edges, item)
+			}
+		}
+		out.issues = append(out.issues, issue)
+	}
+	out.reindex()
+	log.Printf("%d of %d issues existed at %s", len(out.issues), len(ti.issues), t.Format(time.RFC3339))
+	return out
+}
+
+// marshalVersion encodes the labels and assignees of v for the issue_history
+// tables, as JSON arrays.
+func marshalVersion(v *IssueVersion) (labels []byte, assignees []byte, err error) {
+	if labels, err = json.Marshal(append([]string{}, v.Labels...)); err != nil {
+		return
+	}
+	assignees, err = json.Marshal(append([]string{}, v.Assignees...))
+	return
+}
+
+// unmarshalVersion decodes a row of the issue_history tables into v.
+func unmarshalVersion(v *IssueVersion, state string, labels, assignees []byte) error {
+	v.State = githubv4.IssueState(state)
+	if err := json.Unmarshal(labels, &v.Labels); err != nil {
+		return err
+	}
+	return json.Unmarshal(assignees, &v.Assignees)
+}
+
+// saveHistory replaces the stored versions of issues, the statements work on
+// both SQLite and MySQL.
+func saveHistory(tx *sql.Tx, ti *TrackedIssues, issues []IssueNode) error {
+	for i := range issues {
+		id := nodeID(issues[i].ID)
+		if _, err := tx.Exec("DELETE FROM issue_history WHERE issue_id = ?", id); err != nil {
+			return err
+		}
+		for _, v := range ti.History(issues[i].ID) {
+			labels, assignees, err := marshalVersion(&v)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec("INSERT INTO issue_history (issue_id, updated_at, state, closed_at, labels, assignees) VALUES (?, ?, ?, ?, ?, ?)",
+				id, sqliteTime(v.UpdatedAt), string(v.State), sqliteNullTime(v.ClosedAt), labels, assignees)
+			if err != nil {
+				return fmt.Errorf("history of issue %s#%d: %v", issues[i].Repository.Key(), issues[i].Number, err)
+			}
+		}
+	}
+	return nil
+}
+
+// loadHistory reads the stored versions of all issues into ti.
+func loadHistory(db *sql.DB, ti *TrackedIssues) error {
+	rows, err := db.Query("SELECT issue_id, updated_at, state, closed_at, labels, assignees FROM issue_history")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	history := make(map[string][]IssueVersion)
+	for rows.Next() {
+		var id, updatedAt, state string
+		var closedAt sql.NullString
+		var labels, assignees []byte
+		if err := rows.Scan(&id, &updatedAt, &state, &closedAt, &labels, &assignees); err != nil {
+			return err
+		}
+		var v IssueVersion
+		if v.UpdatedAt, err = parseStoredTime(updatedAt); err != nil {
+			return err
+		}
+		if closedAt.Valid {
+			if v.ClosedAt, err = parseStoredTime(closedAt.String); err != nil {
+				return err
+			}
+		}
+		if err := unmarshalVersion(&v, state, labels, assignees); err != nil {
+			return fmt.Errorf("history of issue %s: %v", id, err)
+		}
+		history[id] = append(history[id], v)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, versions := range history {
+		ti.setHistory(githubv4.ID(id), versions)
+	}
+	log.Printf("load history of %d issues", len(history))
+	return nil
+}
+
+// parseStoredTime reads a time column, SQLite gives back the text written
+// while the MySQL driver scans a datetime as RFC3339.
+func parseStoredTime(s string) (time.Time, error) {
+	if t, err := time.Parse(sqliteTimeFormat, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shurcooL/githubv4"
+)
+
+// crossReference returns a timeline item of a pull request that will close
+// the issue, referencing it at t unless t is zero.
+func crossReference(number int, t, prCreated time.Time) IssueTimelineItem {
+	var item IssueTimelineItem
+	event := &item.Node.CrossReferencedEvent
+	event.CreatedAt = githubv4.DateTime{Time: t}
+	event.WillCloseTarget = true
+	pr := &event.Source.PullRequest
+	pr.Number = githubv4.Int(number)
+	pr.CreatedAt = githubv4.DateTime{Time: prCreated}
+	return item
+}
+
+func TestAsOfLinkedPRs(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2022, 3, d, 0, 0, 0, 0, time.UTC) }
+	issue := IssueNode{ID: "I_1", Number: 1, State: githubv4.IssueStateOpen}
+	issue.CreatedAt = githubv4.DateTime{Time: day(1)}
+	issue.UpdatedAt = githubv4.DateTime{Time: day(9)}
+	issue.TimelineItems.Edges = []IssueTimelineItem{
+		crossReference(2, day(3), day(2)),
+		// an older pr referencing the issue after the day looked at
+		crossReference(3, day(7), day(2)),
+		// synced before the time of the references was, told by the pr
+		crossReference(4, time.Time{}, day(4)),
+		crossReference(5, time.Time{}, day(8)),
+	}
+	ti := &TrackedIssues{}
+	ti.Add([]IssueNode{issue})
+
+	var linked []int
+	for _, i := range reportIssues(ti.AsOf(day(5)), nil) {
+		for _, pr := range i.LinkedPRs {
+			linked = append(linked, pr.Number)
+		}
+	}
+	if !equalInts(linked, []int{2, 4}) {
+		t.Errorf("prs linked at March 5th %v, want [2 4]", linked)
+	}
+	if n := len(ti.issues[0].TimelineItems.Edges); n != 4 {
+		t.Errorf("AsOf changed the timeline of the tracked issue to %d items", n)
+	}
+}
@@ -1,18 +1,26 @@
 package main
 
 import (
+	"archive/zip"
 	"context"
 	"encoding/json"
+	"io"
 	"log"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/shurcooL/githubv4"
 )
 
-func getIssuesByTimeRange(owner, name string, labels []string, from time.Time, to time.Time, batchLimit int, totalLimit int) (issues []IssueNode, err error) {
+// getIssuesByTimeRange fetches the issues updated since from, in ascending
+// order of their updated time until passing to. It starts after cursor if
+// given, and calls onPage if given after every page with the cursor of its
+// last issue.
+func getIssuesByTimeRange(owner, name string, labels []string, from time.Time, to time.Time, batchLimit int, totalLimit int, cursor *githubv4.String, onPage func(page []IssueNode, cursor githubv4.String) error) (issues []IssueNode, err error) {
 	var query struct {
+		RateLimited
 		Repository struct {
 			Issues struct {
 				Edges []struct {
@@ -23,8 +31,8 @@ func getIssuesByTimeRange(owner, name string, labels []string, from time.Time, t
 		} `graphql:"repository(name: $name, owner: $owner)"`
 	}
 
-	cursor := (*githubv4.String)(nil)
 	total := 0
+	truncated := 0
 	ghLabels := make([]githubv4.String, 0, len(labels))
 	for _, l := range labels {
 		ghLabels = append(ghLabels, githubv4.String(l))
@@ -53,10 +61,20 @@ func getIssuesByTimeRange(owner, name string, labels []string, from time.Time, t
 			return
 		}
 		edges := query.Repository.Issues.Edges
-
+		page := make([]IssueNode, 0, len(edges))
 		for _, edge := range edges {
-			issues = append(issues, edge.Node)
-			log.Printf("%06d %s %s\n", edge.Node.Number, edge.Node.UpdatedAt.Format(time.RFC3339), edge.Node.Title)
+			page = append(page, edge.Node)
+		}
+		var n int
+		n, err = completeIssues(page)
+		if err != nil {
+			return
+		}
+		truncated += n
+
+		for _, issue := range page {
+			issues = append(issues, issue)
+			log.Printf("%06d %s %s\n", issue.Number, issue.UpdatedAt.Format(time.RFC3339), issue.Title)
 		}
 
 		cnt := len(edges)
@@ -67,6 +85,11 @@ func getIssuesByTimeRange(owner, name string, labels []string, from time.Time, t
 			total += cnt
 			totalLimit -= cnt
 			log.Println(cnt, "fetced", owner, name, labels, lastUpdated)
+			if onPage != nil {
+				if err = onPage(page, lastIssue.Cursor); err != nil {
+					return
+				}
+			}
 			if lastUpdated.After(to) {
 				break
 			}
@@ -76,70 +99,269 @@ func getIssuesByTimeRange(owner, name string, labels []string, from time.Time, t
 		}
 	}
 
-	log.Printf("fetched %d issues from %s/%s\n", total, owner, name)
+	log.Printf("fetched %d issues from %s/%s, completed %d truncated connections\n", total, owner, name, truncated)
 	return
 }
 
 type IDMap map[githubv4.ID]int
 
 type TrackedIssues struct {
+	// mu guards the issues against the sync workers adding to them.
+	mu        sync.Mutex
 	issues    []IssueNode
 	issuesMap IDMap
+	numberMap map[NumberKey]int
 	closedBy  map[githubv4.ID]githubv4.ID
+	// history keeps the versions of every issue seen across syncs, oldest
+	// first, so the reports can look back at a past day.
+	history map[githubv4.ID][]IssueVersion
+	// dirty keeps the issues added or updated since the last save, a store
+	// writing incrementally only has to write them.
+	dirty map[githubv4.ID]bool
+	// events keeps the changes found by Add until the archive logs them.
+	events []ChangeEvent
+}
+
+func (issue *IssueNode) Key() NumberKey {
+	return NumberKey{Repo: issue.Repository.Key(), Number: int(issue.Number)}
+}
+
+// Load decodes the issues of r, a shard of the zip archive or its older
+// issues.json, and appends them. The caller indexes them once every file is
+// read.
+func (ti *TrackedIssues) Load(r io.Reader, where string, ndjson bool) ([]brokenNode, error) {
+	var broken []brokenNode
+	err := decodeNodes(r, where, ndjson, func(data []byte, where string) {
+		var issue IssueNode
+		if err := json.Unmarshal(data, &issue); err != nil {
+			broken = append(broken, newBrokenNode(nodeKindIssue, where, data, err))
+			return
+		}
+		ti.issues = append(ti.issues, issue)
+	})
+	return broken, err
 }
 
-func (ti *TrackedIssues) Load(data []byte) {
-	json.Unmarshal(data, &ti.issues)
-	log.Printf("load %d issues", len(ti.issues))
+func (ti *TrackedIssues) reindex() {
 	ti.issuesMap = make(IDMap)
-	for i, issue := range ti.issues {
-		ti.issuesMap[issue.ID] = i
+	ti.numberMap = make(map[NumberKey]int)
+	for i := range ti.issues {
+		ti.issuesMap[ti.issues[i].ID] = i
+		ti.numberMap[ti.issues[i].Key()] = i
 	}
 }
 
-func (ti *TrackedIssues) Save() []byte {
-	ti.Normalize()
-	issuesJson, err := json.MarshalIndent(ti.issues, "", "\t")
-	if err != nil {
-		log.Fatal(err)
+// Get looks up a tracked issue by its repository and number.
+func (ti *TrackedIssues) Get(repo string, number int) (*IssueNode, bool) {
+	i, ok := ti.numberMap[NumberKey{Repo: repo, Number: number}]
+	if !ok {
+		return nil, false
 	}
-	return issuesJson
+	return &ti.issues[i], true
+}
+
+// Save writes the issues into the zip archive, sharded by the month they
+// were created in.
+func (ti *TrackedIssues) Save(zw *zip.Writer, kept map[string][][]byte) error {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.Normalize()
+	return writeShards(zw, archiveIssuesDir, len(ti.issues),
+		func(i int) time.Time { return ti.issues[i].CreatedAt.Time },
+		func(i int) interface{} { return &ti.issues[i] }, kept)
+}
+
+// Add merges the updated issues, it returns how many of them were not tracked
+// before and how many replaced an older version.
+func (ti *TrackedIssues) Add(updatedIssues []IssueNode) (added int, updated int) {
+	return ti.merge(updatedIssues, false)
 }
 
-func (ti *TrackedIssues) Add(updatedIssues []IssueNode) {
+// merge is Add, the issues not tracked before are logged as opened unless
+// they were found in the past.
+func (ti *TrackedIssues) merge(updatedIssues []IssueNode, past bool) (added int, updated int) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
 	log.Printf("adding %d issues to %d issues", len(updatedIssues), len(ti.issues))
+	if ti.issuesMap == nil {
+		ti.reindex()
+	}
 	for _, issue := range updatedIssues {
 		if i, ok := ti.issuesMap[issue.ID]; ok {
+			if len(ti.history[issue.ID]) == 0 {
+				// tracked before the history was kept
+				ti.record(&ti.issues[i])
+			}
 			if issue.UpdatedAt.Time.After(ti.issues[i].UpdatedAt.Time) {
+				ti.events = append(ti.events, diffIssue(&ti.issues[i], &issue)...)
 				ti.issues[i] = issue
+				ti.record(&issue)
+				ti.markDirty(issue.ID)
+				updated++
+			} else if ti.record(&issue) {
+				// an older version, only the history takes it
+				ti.markDirty(issue.ID)
 			}
 		} else {
 			ti.issuesMap[issue.ID] = len(ti.issues)
+			ti.numberMap[issue.Key()] = len(ti.issues)
 			ti.issues = append(ti.issues, issue)
+			if !past {
+				ti.events = append(ti.events, diffIssue(nil, &issue)...)
+			}
+			ti.record(&issue)
+			ti.markDirty(issue.ID)
+			added++
 		}
 	}
 	log.Printf("%d issues after adding", len(ti.issues))
+	return
+}
+
+// Replace tracks issue in place of the tracked version whatever their updated
+// times, for fsck -repair to put back what GitHub has.
+func (ti *TrackedIssues) Replace(issue IssueNode) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	if ti.issuesMap == nil {
+		ti.reindex()
+	}
+	if i, ok := ti.issuesMap[issue.ID]; ok {
+		ti.issues[i] = issue
+	} else {
+		ti.issuesMap[issue.ID] = len(ti.issues)
+		ti.numberMap[issue.Key()] = len(ti.issues)
+		ti.issues = append(ti.issues, issue)
+	}
+	ti.record(&issue)
+	ti.markDirty(issue.ID)
+}
+
+// dedupe keeps the latest version of the issues stored more than once, it
+// returns how many were dropped.
+func (ti *TrackedIssues) dedupe() int {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	latest := make(map[githubv4.ID]int)
+	kept := ti.issues[:0]
+	for _, issue := range ti.issues {
+		if k, ok := latest[issue.ID]; ok {
+			if issue.UpdatedAt.Time.After(kept[k].UpdatedAt.Time) {
+				kept[k] = issue
+			}
+			ti.markDirty(issue.ID)
+			continue
+		}
+		latest[issue.ID] = len(kept)
+		kept = append(kept, issue)
+	}
+	dropped := len(ti.issues) - len(kept)
+	ti.issues = kept
+	ti.reindex()
+	return dropped
+}
+
+// drop removes the issues of ids along with their history, it returns the
+// issues removed.
+func (ti *TrackedIssues) drop(ids map[githubv4.ID]bool) (dropped []IssueNode) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+	kept := make([]IssueNode, 0, len(ti.issues))
+	for _, issue := range ti.issues {
+		if !ids[issue.ID] {
+			kept = append(kept, issue)
+			continue
+		}
+		dropped = append(dropped, issue)
+		delete(ti.history, issue.ID)
+		delete(ti.dirty, issue.ID)
+	}
+	ti.issues = kept
+	ti.reindex()
+	return
+}
+
+// stripClosedBodies empties the body of the closed issues, it returns how
+// many had one.
+func (ti *TrackedIssues) stripClosedBodies() (n int) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	for i := range ti.issues {
+		issue := &ti.issues[i]
+		if issue.State == githubv4.IssueStateClosed && issue.Body != "" {
+			issue.Body = ""
+			ti.markDirty(issue.ID)
+			n++
+		}
+	}
+	return
+}
+
+func (ti *TrackedIssues) markDirty(id githubv4.ID) {
+	if ti.dirty == nil {
+		ti.dirty = make(map[githubv4.ID]bool)
+	}
+	ti.dirty[id] = true
+}
+
+// takeDirty returns the issues changed since the last call.
+func (ti *TrackedIssues) takeDirty() []IssueNode {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	issues := make([]IssueNode, 0, len(ti.dirty))
+	for id := range ti.dirty {
+		issues = append(issues, ti.issues[ti.issuesMap[id]])
+	}
+	ti.dirty = nil
+	return issues
+}
+
+// takeEvents returns the changes found since the last call.
+func (ti *TrackedIssues) takeEvents() []ChangeEvent {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	events := ti.events
+	ti.events = nil
+	return events
 }
 
 func (ti *TrackedIssues) Normalize() {
 	sort.Slice(ti.issues, func(i, j int) bool {
 		return ti.issues[i].UpdatedAt.Time.After(ti.issues[j].UpdatedAt.Time)
 	})
-	for i, issue := range ti.issues {
-		ti.issuesMap[issue.ID] = i
-	}
+	ti.reindex()
 }
 
-func (ti *TrackedIssues) getUpdateTimeRange() (from time.Time, to time.Time) {
-	if len(ti.issues) == 0 {
-		// if we don't have any tracked things, we initialize from 2 days ago
-		from = time.Now().Add(-48 * time.Hour)
-		to = from
-		return
+// tracks tells whether an issue of repo is tracked.
+func (ti *TrackedIssues) tracks(repo string) bool {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	for i := range ti.issues {
+		if ti.issues[i].Repository.Key() == repo {
+			return true
+		}
 	}
-	from = ti.issues[0].UpdatedAt.Time
-	to = from
+	return false
+}
+
+// getUpdateTimeRange returns the updated time range of the tracked issues of
+// repo, or of all of them if repo is empty.
+func (ti *TrackedIssues) getUpdateTimeRange(repo string) (from time.Time, to time.Time) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	first := true
 	for _, issue := range ti.issues {
+		if repo != "" && issue.Repository.Key() != repo {
+			continue
+		}
+		if first {
+			from = issue.UpdatedAt.Time
+			to = from
+			first = false
+		}
 		if issue.UpdatedAt.Time.After(to) {
 			to = issue.UpdatedAt.Time
 		}
@@ -147,32 +369,39 @@ func (ti *TrackedIssues) getUpdateTimeRange() (from time.Time, to time.Time) {
 			from = issue.UpdatedAt.Time
 		}
 	}
+	if first {
+		// if we don't have any tracked things, we initialize from 2 days ago
+		from = time.Now().Add(-48 * time.Hour)
+		to = from
+	}
 	return
 }
 
-func (ti *TrackedIssues) UpdateByTimeRange(from, to time.Time) (err error, fetched int, added int) {
-	var updated []IssueNode
-	updated, err = getIssuesByTimeRange("pingcap", "tidb", []string{"type/bug"}, from, to, 20, 500)
+// UpdateByTimeRange fetches the issues of repo in the window of cp, resuming
+// from its cursor. Every page is added right away and followed by a call to
+// checkpoint with the cursor of cp moved past the page.
+func (ti *TrackedIssues) UpdateByTimeRange(repo RepositoryConfig, st *SyncState, cp *Checkpoint, checkpoint func() error) (err error, fetched int, added int) {
+	_, err = getIssuesByTimeRange(repo.Owner, repo.Name, repo.Labels, cp.From, cp.To, config.Batch.Issues, config.Batch.Limit, cp.cursor(), func(page []IssueNode, cursor githubv4.String) error {
+		fetched += len(page)
+		n, _ := ti.merge(page, cp.Past)
+		added += n
+		st.advance(cp, cursor)
+		return checkpoint()
+	})
 	if err != nil {
 		log.Printf("error fetching issues %v", err)
-		return
 	}
-	fetched = len(updated)
-	original := len(ti.issues)
-	ti.Add(updated)
-	added = len(ti.issues) - original
 	return
 }
 
-func (ti *TrackedIssues) Update() {
+func (ti *TrackedIssues) Update(repo RepositoryConfig) {
 	var err error
 	var updatedIssues []IssueNode
 
-	from, to := ti.getUpdateTimeRange()
+	from, to := ti.getUpdateTimeRange(repo.String())
 	log.Println("issue update time range", from, to)
-	labels := []string{"type/bug"}
 
-	updatedIssues, err = getIssuesByTimeRange("pingcap", "tidb", labels, to, time.Now(), 20, 500)
+	updatedIssues, err = getIssuesByTimeRange(repo.Owner, repo.Name, repo.Labels, to, time.Now(), config.Batch.Issues, config.Batch.Limit, nil, nil)
 	if err != nil {
 		log.Printf("error fetching issues %v", err)
 		return
@@ -184,7 +413,7 @@ func (ti *TrackedIssues) Update() {
 	earliestTracked := from
 	for {
 		earlier := earliestTracked.Add(-chunkBy)
-		updatedIssues, err = getIssuesByTimeRange("pingcap", "tidb", trackedLabels[0], earlier, earliestTracked, 20, 500)
+		updatedIssues, err = getIssuesByTimeRange(repo.Owner, repo.Name, repo.Labels, earlier, earliestTracked, config.Batch.Issues, config.Batch.Limit, nil, nil)
 		if err == nil {
 			ti.Add(updatedIssues)
 			earliestTracked = earlier
@@ -199,49 +428,86 @@ func (ti *TrackedIssues) Update() {
 	}
 }
 
+// closerOf returns the pull request whose merge closed issue, the last one if
+// it was reopened and closed again, or nil.
+func closerOf(issue *IssueNode) *PullRequest {
+	if issue.State != githubv4.IssueStateClosed {
+		return nil
+	}
+	var closer *PullRequest
+	for i := range issue.TimelineItems.Edges {
+		pr := &issue.TimelineItems.Edges[i].Node.ClosedEvent.Closer.PullRequest
+		if pr.Number != 0 {
+			closer = pr
+		}
+	}
+	return closer
+}
+
+// issueLabels returns the names of the labels of issue.
+func issueLabels(issue *IssueNode) []string {
+	labels := make([]string, 0, len(issue.Labels.Nodes))
+	for _, l := range issue.Labels.Nodes {
+		labels = append(labels, string(l.Name))
+	}
+	return labels
+}
+
 func (ti *TrackedIssues) PopulateClosedBy(tpr *TrackedPullRequests) {
+	tpr.mu.Lock()
+	defer tpr.mu.Unlock()
 	ti.closedBy = make(map[githubv4.ID]githubv4.ID)
-	for _, i := range ti.issues {
-		if i.State == githubv4.IssueStateClosed {
-			for _, edge := range i.TimelineItems.Edges {
-				closer := edge.Node.ClosedEvent.Closer.PullRequest
-				if closer.Number != 0 {
-					tpr.add(closer)
-					ti.closedBy[i.ID] = closer.ID
-				}
-			}
+	for i := range ti.issues {
+		if closer := closerOf(&ti.issues[i]); closer != nil {
+			tpr.addStub(*closer)
+			ti.closedBy[ti.issues[i].ID] = closer.ID
 		}
 	}
 	log.Printf("populated %d closed by relationship", len(ti.closedBy))
 }
 
-var LabelSeverityPrefix = "severity/"
 var LabelAffectedVersionPrefix = "affects-"
 
-func GetClosedIssueInfo(t *TrackedIssues, p *TrackedPullRequests) (infos []ClosedIssueInfo) {
+// GetClosedIssueInfo collects the closed issues of repo, or of all tracked
+// repositories if repo is empty. The closer of an issue may live in another
+// repository.
+func GetClosedIssueInfo(t *TrackedIssues, p *TrackedPullRequests, repo string) (infos []ClosedIssueInfo) {
 	for _, i := range t.issues {
+		if repo != "" && i.Repository.Key() != repo {
+			continue
+		}
 		if i.State == githubv4.IssueStateClosed {
 			info := ClosedIssueInfo{}
+			info.Repository = i.Repository.Key()
 			info.Title = string(i.Title)
 			info.Number = int(i.Number)
 			info.Url = string(i.Url)
 			info.ClosedAt = i.ClosedAt.Time
+			labels := make([]string, 0, len(i.Labels.Nodes))
 			for _, label := range i.Labels.Nodes {
-				if strings.HasPrefix(string(label.Name), LabelSeverityPrefix) {
-					info.Severity = strings.TrimPrefix(string(label.Name), LabelSeverityPrefix)
-				}
+				labels = append(labels, string(label.Name))
 				if strings.HasPrefix(string(label.Name), LabelAffectedVersionPrefix) {
 					info.AffectedVersions = append(info.AffectedVersions, strings.TrimPrefix(string(label.Name), LabelAffectedVersionPrefix))
 				}
 			}
+			info.Severity = config.SeverityOf(labels)
 			if closerID, ok := t.closedBy[i.ID]; ok {
-				pr := &p.prs[p.idMap[closerID]]
-				info.ClosedByPR = pr.getCloserInfo()
-				if cpIDs, ok := p.cherryPickedTo[pr.ID]; ok {
-					for _, cpID := range cpIDs {
-						pr := p.prs[p.idMap[cpID]]
-						info.CloserCherryPicked = append(info.CloserCherryPicked, pr.getCloserInfo())
+				pr, ok := p.byID(closerID)
+				if !ok {
+					log.Printf("closer %v of %s#%d is not tracked, run -fsck", closerID, info.Repository, info.Number)
+				} else {
+					info.ClosedByPR = pr.getCloserInfo()
+					for _, cp := range p.cherryPickedTo[pr.ID] {
+						cpr, ok := p.byID(cp.PR.ID)
+						if !ok {
+							log.Printf("cherry-pick %v of %s is not tracked, run -fsck", cp.PR.ID, pr.Url)
+							continue
+						}
+						by := cpr.getCloserInfo()
+						by.CherryPickReason = cp.Reason
+						info.CloserCherryPicked = append(info.CloserCherryPicked, by)
 					}
+					info.FixedIn = fixedIn(info.ClosedByPR, info.CloserCherryPicked)
 				}
 			}
 			infos = append(infos, info)
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// flock takes an exclusive advisory lock on f, released when f is closed. It
+// fails right away with an error isLocked tells if wait is false and another
+// process holds the lock.
+func flock(f *os.File, wait bool) error {
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	return syscall.Flock(int(f.Fd()), how)
+}
+
+func isLocked(err error) bool {
+	return err == syscall.EWOULDBLOCK
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+	// errorLockViolation is what LockFileEx fails with when told not to wait.
+	errorLockViolation syscall.Errno = 33
+)
+
+// flock takes an exclusive lock on f with LockFileEx, released when f is
+// closed. It fails right away with an error isLocked tells if wait is false
+// and another process holds the lock. The byte locked is past the pid written
+// in the file, which the waiting runs read.
+func flock(f *os.File, wait bool) error {
+	flags := uintptr(lockfileExclusiveLock)
+	if !wait {
+		flags |= lockfileFailImmediately
+	}
+	ol := syscall.Overlapped{OffsetHigh: 1}
+	r, _, err := procLockFileEx.Call(f.Fd(), flags, 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func isLocked(err error) bool {
+	return err == errorLockViolation
+}
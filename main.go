@@ -1,15 +1,14 @@
 package main
 
 import (
-	"archive/zip"
 	"bytes"
 	"context"
-	"database/sql"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"sort"
 	"strings"
@@ -21,26 +20,18 @@ import (
 
 	"github.com/olekukonko/tablewriter"
 	"github.com/shurcooL/githubv4"
-	"golang.org/x/oauth2"
 )
 
+// dbUrl is the DSN of the MySQL database the reports are generated from.
 var dbUrl string
-var client *githubv4.Client
 var trackedIssues map[githubv4.ID]IssueNode
-var batchLimit = 100
 var debug = false
 var report = true
-var trackedLabels = [][]string{
-	// {"sig/planner"},
-	// {"sig/execution"},
-	// {"sig/transaction"},
-	// {"sig/DDL"},
-	{"type/bug"},
-}
 var PostToIssueID githubv4.ID
 
 func initPostIssueID() error {
 	var query struct {
+		RateLimited
 		Repository struct {
 			Issue struct {
 				ID githubv4.ID
@@ -48,9 +39,9 @@ func initPostIssueID() error {
 		} `graphql:"repository(owner: $owner, name: $name)"`
 	}
 	err := client.Query(context.Background(), &query, map[string]interface{}{
-		"name":   githubv4.String("tidb"),
-		"owner":  githubv4.String("pingcap"),
-		"number": githubv4.Int(20804),
+		"name":   githubv4.String(config.Report.Name),
+		"owner":  githubv4.String(config.Report.Owner),
+		"number": githubv4.Int(config.Report.Issue),
 	})
 	if err != nil {
 		return err
@@ -61,140 +52,30 @@ func initPostIssueID() error {
 
 func init() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
-
-	gt := os.Getenv("GITHUB_TOKEN")
-	if gt == "" {
-		log.Fatal("no GITHUB_TOKEN found in env")
-	}
-	src := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: gt},
-	)
-	httpClient := oauth2.NewClient(context.Background(), src)
-	client = githubv4.NewClient(httpClient)
 }
 
-// func updateDatabase() {
-// 	db, err := sql.Open("mysql", dbUrl)
-// 	if err != nil {
-// 		log.Fatal(err)
-// 	}
-// 	re, err := regexp.Compile(`## Score\s*?-\s*?(\d+)\s*?## Mentor\s*?\* @(\w+)`)
-// 	if err != nil {
-// 		log.Fatal(err)
-// 	}
-// 	for _, issue := range trackedIssues {
-// 		// parse score & mentor & hint
-// 		// ## Score\n- 300\n\n## Mentor\n * @qw4990
-// 		strMatches := re.FindAllStringSubmatch(string(issue.Body), -1)
-// 		var score, mentor string
-// 		if len(strMatches) != 0 {
-// 			idx := len(strMatches) - 1
-// 			score, mentor = strMatches[idx][1], strMatches[idx][2]
-// 		}
-// 		closedAt := &issue.ClosedAt.Time
-// 		if closedAt.IsZero() {
-// 			closedAt = nil
-// 		}
-// 		// insert issue
-// 		res, err := db.Exec("insert into issue(owner, repository, number, title, author, created_at, updated_at, closed_at, state, url, score, mentor) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) on duplicate key update updated_at=?, closed_at=?, title=?, state=?, score=?, mentor=?",
-// 			issue.Repository.Owner.Login, issue.Repository.Name, issue.Number, issue.Title, issue.Author.Login, issue.CreatedAt.Time, issue.UpdatedAt.Time, closedAt, issue.State, issue.Url, score, mentor,
-// 			issue.UpdatedAt.Time, closedAt, issue.Title, issue.State, score, mentor)
-// 		if err != nil {
-// 			log.Fatal(err)
-// 		}
-// 		issueId, err := res.LastInsertId()
-// 		if err != nil {
-// 			log.Fatal(err)
-// 		}
-// 		if issueId == 0 {
-// 			res, err := db.Query("select id from issue where owner=? and repository=? and number=?", issue.Repository.Owner.Login, issue.Repository.Name, issue.Number)
-// 			if err != nil {
-// 				log.Fatal(err)
-// 			}
-// 			res.Next()
-// 			if err = res.Scan(&issueId); err != nil {
-// 				log.Fatal(err)
-// 			}
-// 			res.Close()
-// 		}
-
-// 		// insert label
-// 		if _, err := db.Exec("delete from label where issue_id = ?", issueId); err != nil {
-// 			log.Fatal(err)
-// 		}
-// 		for _, label := range issue.Labels.Nodes {
-// 			_, err := db.Exec("insert into label (issue_id, name) values (?, ?) on duplicate key update issue_id=issue_id, name=name", issueId, label.Name)
-// 			if err != nil {
-// 				log.Fatal(err)
-// 			}
-// 		}
-
-// 		// insert assignee
-// 		if _, err := db.Exec("delete from assignee where issue_id = ?", issueId); err != nil {
-// 			log.Fatal(err)
-// 		}
-// 		for _, assignee := range issue.Assignees.Nodes {
-// 			_, err := db.Exec("insert into assignee (issue_id, name, created_at) values (?, ?, ?) on duplicate key update issue_id=issue_id, name=name", issueId, assignee.Login, assignee.CreatedAt.Time)
-// 			if err != nil {
-// 				log.Fatal(err)
-// 			}
-// 		}
-
-// 		// insert PRs
-// 		if _, err := db.Exec("delete from close where issue_id = ?", issueId); err != nil {
-// 			log.Fatal(err)
-// 		}
-// 		for _, edge := range issue.TimelineItems.Edges {
-// 			event := edge.Node.CrossReferencedEvent
-// 			if !event.WillCloseTarget {
-// 				continue
-// 			}
-// 			pr := event.Source.PullRequest
-// 			res, err := db.Exec("insert into pull_request (owner, repository, number, title, author, created_at, updated_at, state, url) values (?, ?, ?, ?, ?, ?, ?, ?, ?) on duplicate key update updated_at=?, title=?, state=?", pr.Repository.Owner.Login, pr.Repository.Name, pr.Number, pr.Title, pr.Author.Login, pr.CreatedAt.Time, pr.UpdatedAt.Time, pr.State, pr.Url, pr.UpdatedAt.Time, pr.Title, pr.State)
-// 			if err != nil {
-// 				log.Fatal("failed on insert PR", err)
-// 			}
-// 			prId, err := res.LastInsertId()
-// 			if err != nil {
-// 				log.Fatal(err)
-// 			}
-// 			if prId == 0 {
-// 				res, err := db.Query("select id from pull_request where owner=? and repository=? and number=?", pr.Repository.Owner.Login, pr.Repository.Name, pr.Number)
-// 				if err != nil {
-// 					log.Fatal(err)
-// 				}
-// 				res.Next()
-// 				if err = res.Scan(&prId); err != nil {
-// 					log.Fatal(err)
-// 				}
-// 				res.Close()
-// 			}
-// 			if _, err := db.Exec("insert into close(issue_id, pull_request_id) values (?, ?)", issueId, prId); err != nil {
-// 				log.Fatal("failed insert close", err)
-// 			}
-// 		}
-
-// 	}
-// }
-
-func generateTrackTable() string {
-	mysqlDB, err := sql.Open("mysql", dbUrl)
-	if err != nil {
-		log.Fatal(err)
-	}
-	db := DB{mysqlDB}
-
+// generateTrackTable renders the open issues of every label set of the report
+// config from the storage of a, or from the history of the issues as they were
+// at asOf unless it is zero.
+func generateTrackTable(a *Archive, asOf time.Time) (string, error) {
 	tables := make([]string, 0)
 
-	for _, labels := range trackedLabels {
-		issues := db.GetIssues("OPEN", labels)
+	var past *TrackedIssues
+	if !asOf.IsZero() {
+		past = a.Issues.AsOf(asOf)
+	}
+	for _, labels := range config.Report.Labels {
+		var issues []Issue
+		var err error
+		if past != nil {
+			issues = reportIssues(past, labels)
+		} else if issues, err = a.ReportIssues(labels); err != nil {
+			return "", err
+		}
 		header := []string{"issue", "priority", "assignee", "pr", "hint"}
 		data := make([][]string, 0, len(issues))
 
 		for _, i := range issues {
-			i.Labels = db.GetIssueLabelsByID(i.ID)
-			i.Assignees = db.GetIssueAssigneesByID(i.ID)
-			i.LinkedPRs = db.GetIssueLinkedPRsByID(i.ID)
 			isBug := false
 			for _, l := range i.Labels {
 				if l == "type/bug" {
@@ -209,7 +90,7 @@ func generateTrackTable() string {
 			linked := false
 			d := make([]string, 0, len(header))
 			// issue
-			d = append(d, fmt.Sprintf("[#%d](%s)", i.Number, i.Url))
+			d = append(d, fmt.Sprintf("[#%d](%s)", i.Number, i.link()))
 
 			// challenge
 			d = append(d, func(i Issue) string {
@@ -243,23 +124,7 @@ func generateTrackTable() string {
 			d = d[:len(d)-1]
 
 			// priority
-			d = append(d, func(labels []string) string {
-				for _, l := range labels {
-					if l == "severity/critical" {
-						return "critical"
-					}
-					if l == "severity/major" {
-						return "major"
-					}
-					if l == "severity/moderate" {
-						return "moderate"
-					}
-					if l == "severity/minor" {
-						return "minor"
-					}
-				}
-				return ""
-			}(i.Labels))
+			d = append(d, config.SeverityOf(i.Labels))
 
 			// assignee
 			d = append(d, strings.Join(func(a []Assignee) (result []string) {
@@ -280,7 +145,7 @@ func generateTrackTable() string {
 			// pr
 			d = append(d, strings.Join(func(a []LinkedPR) (result []string) {
 				for i := range a {
-					result = append(result, fmt.Sprintf("[#%d](%s)", a[i].Number, a[i].Url))
+					result = append(result, fmt.Sprintf("[#%d](%s)", a[i].Number, a[i].link()))
 					linked = true
 				}
 				return
@@ -293,12 +158,7 @@ func generateTrackTable() string {
 			}
 			data = append(data, d)
 		}
-		order := map[string]int{
-			"critical": 1,
-			"major":    2,
-			"moderate": 3,
-			"minor":    4,
-		}
+		order := config.SeverityOrder()
 		sort.SliceStable(data, func(i, j int) bool {
 			ii, iok := order[data[i][2]]
 			jj, jok := order[data[j][2]]
@@ -371,27 +231,35 @@ Feel free to comment on issues that interest you, and ask whatever questions you
 updated at {{ .UpdatedAt }}
 
 `
+	// the template has a section for each of four label sets
+	for len(tables) < 4 {
+		tables = append(tables, "")
+	}
 	now := time.Now()
+	if !asOf.IsZero() {
+		now = asOf
+	}
 	tbs := Tables{tables[0], tables[1], tables[2], tables[3], fmt.Sprintf("%d-%02d-%02dT%02d:%02d:%02d-00:00\n",
 		now.Year(), now.Month(), now.Day(),
 		now.Hour(), now.Minute(), now.Second())}
 	t, err := template.New("content").Parse(tp)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 	var buf bytes.Buffer
-	err = t.Execute(&buf, tbs)
-	content := strings.Join(tables, "\n\n")
-	content = string(buf.Bytes())
+	if err := t.Execute(&buf, tbs); err != nil {
+		return "", err
+	}
+	content := string(buf.Bytes())
 	log.Println(content)
-	if err := ioutil.WriteFile("index.md", []byte(content), 0644); err != nil {
-		log.Fatal(err)
+	if err := ioutil.WriteFile(config.Report.Output, []byte(content), 0644); err != nil {
+		return "", err
 	}
-	return content
+	return content, nil
 }
 
 func reportToIssue(content string) (url string, err error) {
-	title := "Welcome to contribute"
+	title := config.Report.Title
 
 	var m struct {
 		UpdateIssue struct {
@@ -413,145 +281,290 @@ func reportToIssue(content string) (url string, err error) {
 	return
 }
 
-func update(ti *TrackedIssues, tpr *TrackedPullRequests, extend int) {
-	tiFrom, tiTo := ti.getUpdateTimeRange()
+func main() {
+	configPath := flag.String("config", os.Getenv("TRACKER_CONFIG"), "the config file declaring tracked repositories and report targets, defaults to $TRACKER_CONFIG")
+	getContri := flag.Bool("contri", false, "get contributors")
+	getIssueInfo := flag.Int("issue", 0, "the number of the issue to be examined")
+	runUpdate := flag.Bool("update", false, "if run update")
+	scopeRepo := flag.String("repo", "", "only report issues of the given owner/name or repository URL, all tracked repositories by default")
+	numExtend := flag.Int("extend", 0, "the number of issues to extend back in history")
+	recordPath := flag.String("record", "", "record GitHub queries and responses to the given cassette file")
+	replayPath := flag.String("replay", "", "serve GitHub queries from the given cassette file recorded by -record, without network")
+	runBackfill := flag.Bool("backfill", false, "fetch the issues and prs updated from -since to -until, of the -repo only if given")
+	backfillSince := flag.String("since", "", "the start of the backfill window, a date like 2021-06-01 or an RFC3339 time")
+	backfillUntil := flag.String("until", "", "the end of the backfill window, now by default")
+	backfillLabels := flag.String("labels", "", "comma separated labels replacing the configured issue labels of the backfill")
+	archivePath := flag.String("archive", "", "the archive to sync into in place of storage.path of the config, a SQLite database if it ends in .db, .sqlite or .sqlite3")
+	importPath := flag.String("import", "", "copy the given zip archive into the storage")
+	flag.StringVar(&dbUrl, "mysql", os.Getenv("MYSQL_URL"), "the DSN of the MySQL database of the mysql storage backend, defaults to $MYSQL_URL")
+	runCompact := flag.Bool("compact", false, "drop what the retention rules of the config don't keep from the archive and report the bytes reclaimed, after -update if given")
+	showBackups := flag.Bool("backups", false, "list the previous zip archives kept by storage.backups and exit")
+	restoreN := flag.Int("restore", 0, "roll the zip archive back to the given backup, 1 being the latest, and exit")
+	runMigrate := flag.Bool("migrate", false, "apply the pending schema migrations of the SQLite or MySQL storage and exit")
+	runFsck := flag.Bool("fsck", false, "check the archive for undecodable or duplicate nodes, dangling closers and cherry-picks, untracked repositories and timestamps out of order, and exit")
+	fsckRepair := flag.Bool("repair", false, "with -fsck, drop the duplicates and refetch the broken nodes from GitHub")
+	listChanges := flag.Bool("changes", false, "list the changes found by the syncs since the last -changes, or recorded since -since if given")
+	asOfTime := flag.String("as-of", "", "report the issues as they were at the given date or RFC3339 time, from the history kept by the syncs")
+	genTable := flag.Bool("table", false, "render the open issues of the report label sets into report.output")
+	serveAddr := flag.String("serve", "", "listen on the given address for GitHub webhook deliveries signed by $GITHUB_WEBHOOK_SECRET")
+	flag.Parse()
 
-	now := time.Now()
-	err, fetched, added := ti.UpdateByTimeRange(tiTo, now)
+	var err error
+	config, err = loadConfig(*configPath)
 	if err != nil {
-		log.Println("failed to update issue", err)
-		return
-	}
-	log.Printf("fetched %d added %d to tracked issues", fetched, added)
-	err, fetched, added = tpr.Update(tiTo)
-	if err != nil {
-		log.Println("failed to update pr", err)
-		return
+		log.Fatal(err)
 	}
-	log.Printf("fetched %d added %d to tracked prs", fetched, added)
 
-	accumulated := 0
-	extendBy := 48 * time.Hour
-	for accumulated < extend {
-		earlier := tiFrom.Add(-extendBy)
-		err, fetched, added = ti.UpdateByTimeRange(earlier, tiFrom)
-		tiFrom = earlier
-		if err != nil {
-			log.Println("failed to update")
-			break
+	var asOf time.Time
+	if *asOfTime != "" {
+		if asOf, err = parseBackfillTime(*asOfTime); err != nil {
+			log.Fatal(err)
 		}
-		accumulated += fetched
-		log.Printf("fetched %d added %d to tracked issue\n", fetched, added)
-		log.Printf("issue tracked from %s\n", tiFrom)
-		log.Printf("accumulated fetching %d limit by %d\n", accumulated, extend)
 	}
-}
 
-func readFileFromZip(fp string) (map[string][]byte, error) {
-	r, err := zip.OpenReader(fp)
-	if err != nil {
-		return nil, err
+	if *archivePath != "" {
+		// the backend follows the extension of the path given
+		config.Storage.Backend = ""
+		config.Storage.Path = *archivePath
 	}
-	defer r.Close()
 
-	files := make(map[string][]byte)
+	if *scopeRepo != "" {
+		if *scopeRepo, err = config.GitHub.ParseRepository(*scopeRepo); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	for _, f := range r.File {
-		rc, err := f.Open()
+	var pool *tokenPool
+	if *replayPath != "" {
+		rp, err := newReplayer(*replayPath)
 		if err != nil {
-			return nil, err
+			log.Fatal(err)
 		}
-		files[f.Name], err = ioutil.ReadAll(rc)
+		defer func() {
+			log.Printf("%d interactions left in the cassette", rp.Remaining())
+		}()
+		client = githubv4.NewEnterpriseClient(config.GitHub.GraphQL, &http.Client{Transport: rp})
+	} else if *runUpdate || *runBackfill || *serveAddr != "" || *getContri || (*runFsck && *fsckRepair) {
+		httpClient, tokens, err := newHTTPClient()
 		if err != nil {
-			return nil, err
+			log.Fatal(err)
 		}
-		rc.Close()
+		if *recordPath != "" {
+			rec, err := newRecorder(*recordPath, httpClient.Transport)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer rec.Close()
+			httpClient.Transport = rec
+		}
+		client = githubv4.NewEnterpriseClient(config.GitHub.GraphQL, httpClient)
+		pool = tokens
+	}
+	if client != nil {
+		rl := newRateLimitedFetcher(client)
+		rl.pool = pool
+		defer rl.Summary()
+		client = rl
 	}
-	return files, nil
-}
 
-func writeFileToZip(fp string, files map[string][]byte) error {
-	zipFile, err := os.Create(fp)
+	if *runMigrate {
+		// opening the storage applies them
+		config.Storage.ManualMigrations = false
+	}
+	storage, err := openStorage(config.Storage, dbUrl)
 	if err != nil {
-		return err
+		log.Fatal(err)
 	}
-	zipFileWriter := zip.NewWriter(zipFile)
-	defer zipFileWriter.Close()
-
-	for name, content := range files {
-		fileWriter, err := zipFileWriter.Create(name)
-		if err != nil {
-			return err
+	if *runMigrate {
+		if _, ok := storage.(*zipStorage); ok {
+			log.Printf("the zip storage %s has no schema to migrate", config.Storage.Path)
+		} else {
+			log.Println("the schema is up to date")
 		}
-		contentLen := len(content)
-		for contentLen > 0 {
-			n, err := fileWriter.Write(content)
-			if err != nil {
-				return err
+		storage.Close()
+		return
+	}
+	if *showBackups || *restoreN != 0 {
+		zs, ok := storage.(*zipStorage)
+		if !ok {
+			log.Fatalf("backups are kept of the zip storage only, not of %s", config.Storage.Path)
+		}
+		if *restoreN != 0 {
+			if err := zs.Lock(); err != nil {
+				log.Fatal(err)
+			}
+			if err := zs.restore(*restoreN); err != nil {
+				log.Fatal(err)
 			}
-			contentLen -= n
-			content = content[n:]
 		}
+		fmt.Print(formatBackups(listBackups(zs.Path)))
+		zs.Close()
+		return
 	}
-	return nil
-}
-
-func main() {
-	getContri := flag.Bool("contri", false, "get contributors")
-	getIssueInfo := flag.Int("issue", 0, "the number of the issue to be examined")
-	runUpdate := flag.Bool("update", false, "if run update")
-	numExtend := flag.Int("extend", 0, "the number of issues to extend back in history")
-	flag.Parse()
-
-	archiveFilePath := "raw.zip"
-	issuesPath := "issues.json"
-	prsPath := "prs.json"
-
-	ti := &TrackedIssues{}
-	tpr := &TrackedPullRequests{}
-	start := time.Now()
-
-	fileData, err := readFileFromZip(archiveFilePath)
-	if err != nil {
+	a := NewArchive(storage)
+	if *runFsck {
+		if *fsckRepair {
+			if err := storage.Lock(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		loadErr := a.Load()
+		problems := fsck(a, loadErr)
+		fmt.Print(formatFsck(problems))
+		if *fsckRepair && len(problems) != 0 && a.partial {
+			// saving would rewrite the archive with only what was read
+			log.Fatalf("not repairing %s, it doesn't load whole, restore a backup with -restore", config.Storage.Path)
+		}
+		if *fsckRepair && len(problems) != 0 {
+			fixed, failed := repair(a, problems)
+			if err := a.Save(); err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("refetched %d nodes, %d failed", fixed, failed)
+			loadErr = a.Load()
+			if loadErr != nil {
+				log.Println(loadErr)
+			}
+			problems = fsck(a, loadErr)
+			fmt.Printf("\nafter repair: %s", formatFsck(problems))
+		}
+		a.Close()
+		if len(problems) != 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	// the modes saving the archive hold its lock from the load to their last
+	// save, the reports and the webhook server go on without it
+	saves := *importPath != "" || *runUpdate || *runCompact || *runBackfill || (*listChanges && *backfillSince == "")
+	if saves {
+		if err := storage.Lock(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := a.Load(); err != nil {
 		log.Fatal(err)
 	}
+	defer a.Close()
 
-	if issuesData, ok := fileData[issuesPath]; ok {
-		ti.Load(issuesData)
-	} else {
-		log.Println("no issues data")
+	if *importPath != "" {
+		src := NewArchive(&zipStorage{Path: *importPath})
+		if err := src.Load(); err != nil {
+			log.Fatal(err)
+		}
+		issues, prs := a.Import(src)
+		if err := a.Save(); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("imported %d issues and %d prs from %s", issues, prs, *importPath)
 	}
+	ti, tpr, st := a.Issues, a.PullRequests, a.Sync
 
-	if prsData, ok := fileData[prsPath]; ok {
-		tpr.Load(prsData)
-	} else {
-		log.Println("no prs data")
+	if *runUpdate {
+		update(a, *numExtend)
+		if err := a.Save(); err != nil {
+			log.Println(err)
+		}
 	}
 
-	log.Printf("data loaded in %v", time.Now().Sub(start))
-
-	if *runUpdate {
-		update(ti, tpr, *numExtend)
+	if *runCompact {
+		c, err := a.Compact(config.Retention, time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(c.String())
+	}
 
-		files := make(map[string][]byte)
-		files[issuesPath] = ti.Save()
-		files[prsPath] = tpr.Save()
-		tmpFilePath := "tmp.zip"
-		if err := writeFileToZip(tmpFilePath, files); err != nil {
+	if *runBackfill {
+		if *backfillSince == "" {
+			log.Fatal("-backfill requires -since")
+		}
+		since, err := parseBackfillTime(*backfillSince)
+		if err != nil {
+			log.Fatal(err)
+		}
+		until := time.Now()
+		if *backfillUntil != "" {
+			if until, err = parseBackfillTime(*backfillUntil); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if !since.Before(until) {
+			log.Fatalf("empty backfill window from %s to %s", since, until)
+		}
+		var repos []RepositoryConfig
+		for _, repo := range trackedRepositories(st) {
+			if *scopeRepo == "" || repo.String() == *scopeRepo {
+				repos = append(repos, repo)
+			}
+		}
+		if len(repos) == 0 {
+			log.Fatalf("no tracked repository matches %q", *scopeRepo)
+		}
+		var labels []string
+		if *backfillLabels != "" {
+			labels = strings.Split(*backfillLabels, ",")
+		}
+		stats, err := backfill(a, repos, labels, since, until)
+		if err := a.Save(); err != nil {
 			log.Println(err)
+		}
+		fmt.Printf("backfill from %s to %s\n%s", since.Format(time.RFC3339), until.Format(time.RFC3339), formatBackfillStats(stats))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *listChanges {
+		var events []ChangeEvent
+		if *backfillSince != "" && !*runBackfill {
+			since, err := parseBackfillTime(*backfillSince)
+			if err != nil {
+				log.Fatal(err)
+			}
+			events = a.Events.RecordedSince(since)
 		} else {
-			// atomically replace the old zip file
-			if err := os.Rename(tmpFilePath, archiveFilePath); err != nil {
-				log.Println(err)
+			events = a.Events.Since(a.Events.Seen)
+			if len(events) != 0 {
+				a.Events.mu.Lock()
+				a.Events.Seen = events[len(events)-1].Seq
+				a.Events.mu.Unlock()
+				if err := a.Save(); err != nil {
+					log.Fatal(err)
+				}
 			}
 		}
+		fmt.Printf("%d changes\n%s", len(events), formatChanges(events))
+	}
+	if saves {
+		if err := storage.Unlock(); err != nil {
+			log.Println(err)
+		}
+	}
+
+	if *serveAddr != "" {
+		secret := os.Getenv("GITHUB_WEBHOOK_SECRET")
+		if secret == "" {
+			log.Fatal("no GITHUB_WEBHOOK_SECRET found in env")
+		}
+		log.Printf("listening on %s for webhook deliveries", *serveAddr)
+		s := NewWebhookServer(a, secret)
+		go s.Run()
+		log.Fatal(http.ListenAndServe(*serveAddr, s))
 	}
 
+	if !asOf.IsZero() {
+		ti = ti.AsOf(asOf)
+	}
 	ti.PopulateClosedBy(tpr)
 	tpr.PopulateCherryPickedTo()
 	log.Printf("%d issues and %d prs in track", len(ti.issues), len(tpr.prs))
 
-	infos := GetClosedIssueInfo(ti, tpr)
+	releaseTags = newTagResolver(config, trackedRepositories(st))
+	infos := GetClosedIssueInfo(ti, tpr, *scopeRepo)
+	if err := releaseTags.Save(); err != nil {
+		log.Println(err)
+	}
 	data, err := json.MarshalIndent(infos, "", "\t")
 	if err != nil {
 		log.Println(err)
@@ -559,20 +572,19 @@ func main() {
 	ioutil.WriteFile("infos.json", data, 0644)
 
 	if *getContri {
-		err := getContributors()
+		repos := trackedRepositories(st)
+		if len(repos) == 0 {
+			log.Fatal("no repository to get contributors from, run -update to discover one")
+		}
+		err := getContributors(repos[0])
 		if err != nil {
 			panic(err)
 		}
 	} else if *getIssueInfo != 0 {
 		fmt.Printf("okay to track")
-	} else {
-		// initForTrack()
-		// fmt.Println(len(trackedIssues))
-		// updateDatabase()
-		// content := generateTrackTable()
-		// _ = content
-		// if report {
-		// 	reportToIssue(content)
-		// }
+	} else if *genTable {
+		if _, err := generateTrackTable(a, asOf); err != nil {
+			log.Fatal(err)
+		}
 	}
 }
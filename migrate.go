@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles holds the up-migrations of each dialect, named like
+// migrations/mysql/0002_drop_sdfs.sql. A migration once released is never
+// edited, a schema change goes into a new file with the next version.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// schemaVersionTable records the migrations applied to a database, the same
+// statement works on both MySQL and SQLite.
+const schemaVersionTable = `CREATE TABLE IF NOT EXISTS schema_version (
+	version    int NOT NULL PRIMARY KEY,
+	name       varchar(255) NOT NULL,
+	applied_at datetime NOT NULL
+)`
+
+type migration struct {
+	version int
+	name    string
+	script  string
+}
+
+// loadMigrations returns the migrations of dialect ordered by version.
+func loadMigrations(dialect string) ([]migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations of %s: %v", dialect, err)
+	}
+	var ms []migration
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".sql")
+		if e.IsDir() || name == e.Name() {
+			continue
+		}
+		parts := strings.SplitN(name, "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || version <= 0 || len(parts) != 2 {
+			return nil, fmt.Errorf("migration %s/%s is not named like 0001_name.sql", dir, e.Name())
+		}
+		data, err := migrationFiles.ReadFile(path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, migration{version: version, name: parts[1], script: string(data)})
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].version < ms[j].version })
+	for i := range ms {
+		if ms[i].version != i+1 {
+			return nil, fmt.Errorf("migrations of %s: expect version %d, got %d", dialect, i+1, ms[i].version)
+		}
+	}
+	return ms, nil
+}
+
+// splitStatements splits a script at the semicolons ending a line, the MySQL
+// driver runs a single statement at a time.
+func splitStatements(script string) []string {
+	var stmts []string
+	var cur []string
+	for _, line := range strings.Split(script, "\n") {
+		cur = append(cur, line)
+		if strings.HasSuffix(strings.TrimSpace(line), ";") {
+			stmts = appendStatement(stmts, cur)
+			cur = nil
+		}
+	}
+	return appendStatement(stmts, cur)
+}
+
+// appendStatement appends the lines unless they are only comments.
+func appendStatement(stmts []string, lines []string) []string {
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "--") {
+			return append(stmts, strings.TrimSuffix(strings.TrimSpace(strings.Join(lines, "\n")), ";"))
+		}
+	}
+	return stmts
+}
+
+// schemaVersion returns the latest migration applied to db, 0 for none.
+func schemaVersion(db *sql.DB) (int, error) {
+	if _, err := db.Exec(schemaVersionTable); err != nil {
+		return 0, err
+	}
+	var version sql.NullInt64
+	if err := db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// pendingMigrations returns the migrations of dialect not yet applied to db.
+func pendingMigrations(db *sql.DB, dialect string) ([]migration, error) {
+	ms, err := loadMigrations(dialect)
+	if err != nil {
+		return nil, err
+	}
+	version, err := schemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	if version > len(ms) {
+		return nil, fmt.Errorf("schema version %d is newer than the %d migrations known to this build", version, len(ms))
+	}
+	return ms[version:], nil
+}
+
+// migrate applies the pending migrations of dialect to db in order, each one
+// in a transaction along with its row of schema_version. MySQL commits DDL
+// right away, so a migration failing there may be left half applied.
+func migrate(db *sql.DB, dialect string) (applied int, err error) {
+	pending, err := pendingMigrations(db, dialect)
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range pending {
+		start := time.Now()
+		tx, err := db.Begin()
+		if err != nil {
+			return applied, err
+		}
+		for _, stmt := range splitStatements(m.script) {
+			if _, err := tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return applied, fmt.Errorf("migration %04d_%s: %v", m.version, m.name, err)
+			}
+		}
+		_, err = tx.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)",
+			m.version, m.name, time.Now().UTC().Format(sqliteTimeFormat))
+		if err != nil {
+			tx.Rollback()
+			return applied, err
+		}
+		if err := tx.Commit(); err != nil {
+			return applied, err
+		}
+		applied++
+		log.Printf("applied %s migration %04d_%s in %v", dialect, m.version, m.name, time.Now().Sub(start))
+	}
+	return applied, nil
+}
+
+// prepareSchema brings the schema of db up to date when opening a storage,
+// unless storage.manualMigrations is set, in which case a pending migration
+// is an error until -migrate applies it.
+func prepareSchema(db *sql.DB, dialect string) error {
+	if !config.Storage.ManualMigrations {
+		_, err := migrate(db, dialect)
+		return err
+	}
+	pending, err := pendingMigrations(db, dialect)
+	if err != nil {
+		return err
+	}
+	if len(pending) != 0 {
+		return fmt.Errorf("%d %s migrations pending up to %04d_%s, run -migrate to apply them",
+			len(pending), dialect, pending[len(pending)-1].version, pending[len(pending)-1].name)
+	}
+	return nil
+}
@@ -0,0 +1,2 @@
+-- A leftover of some manual testing that made it into db.sql.
+DROP TABLE IF EXISTS `sdfs`;
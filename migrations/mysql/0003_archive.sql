@@ -0,0 +1,27 @@
+-- The whole nodes and the sync state of the mysql storage backend, so the
+-- archive can be loaded back from MySQL.
+
+CREATE TABLE IF NOT EXISTS `archive_node` (
+  `id` varchar(64) NOT NULL,
+  `kind` enum('ISSUE','PULL_REQUEST') NOT NULL,
+  `owner` varchar(64) NOT NULL,
+  `repository` varchar(64) NOT NULL,
+  `number` int NOT NULL,
+  `updated_at` datetime NOT NULL,
+  `data` longtext NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `UK_kind_owner_repository_number` (`kind`,`owner`,`repository`,`number`),
+  KEY `updated_at` (`updated_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS `sync_state` (
+  `repo` varchar(130) NOT NULL,
+  `data` text NOT NULL,
+  PRIMARY KEY (`repo`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS `meta` (
+  `key` varchar(64) NOT NULL,
+  `value` longtext NOT NULL,
+  PRIMARY KEY (`key`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
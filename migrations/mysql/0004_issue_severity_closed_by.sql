@@ -0,0 +1,6 @@
+-- severity is the level of the severity labels of the config, closed_by the
+-- pull_request row of the pr that closed the issue.
+ALTER TABLE `issue`
+  ADD COLUMN `severity` varchar(16) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci DEFAULT NULL,
+  ADD COLUMN `closed_by` int DEFAULT NULL,
+  ADD KEY `closed_by` (`closed_by`);
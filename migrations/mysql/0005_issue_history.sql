@@ -0,0 +1,12 @@
+-- The versions of the state, labels and assignees of every issue seen across
+-- syncs, issue_id is the node id of archive_node, labels and assignees are
+-- JSON arrays.
+CREATE TABLE IF NOT EXISTS `issue_history` (
+  `issue_id` varchar(64) NOT NULL,
+  `updated_at` datetime NOT NULL,
+  `state` enum('OPEN','CLOSED') NOT NULL,
+  `closed_at` datetime DEFAULT NULL,
+  `labels` text NOT NULL,
+  `assignees` text NOT NULL,
+  PRIMARY KEY (`issue_id`,`updated_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
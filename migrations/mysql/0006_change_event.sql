@@ -0,0 +1,13 @@
+-- The change events found by the syncs, data is the whole event as JSON.
+CREATE TABLE IF NOT EXISTS `change_event` (
+  `seq` bigint NOT NULL,
+  `type` varchar(32) NOT NULL,
+  `repo` varchar(130) NOT NULL,
+  `number` int NOT NULL,
+  `at` datetime NOT NULL,
+  `recorded_at` datetime NOT NULL,
+  `data` text NOT NULL,
+  PRIMARY KEY (`seq`),
+  KEY `repo_number` (`repo`,`number`),
+  KEY `recorded_at` (`recorded_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
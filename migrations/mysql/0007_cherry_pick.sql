@@ -0,0 +1,10 @@
+-- The cherry-picks of every pull request, pr_id and cherry_pick_id are node
+-- ids of archive_node. reason tells how the cherry-pick was found: body, head
+-- ref or label.
+CREATE TABLE IF NOT EXISTS `cherry_pick` (
+  `pr_id` varchar(64) NOT NULL,
+  `cherry_pick_id` varchar(64) NOT NULL,
+  `reason` varchar(16) NOT NULL DEFAULT '',
+  PRIMARY KEY (`pr_id`,`cherry_pick_id`),
+  KEY `cherry_pick_id` (`cherry_pick_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
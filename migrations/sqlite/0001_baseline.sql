@@ -0,0 +1,85 @@
+CREATE TABLE IF NOT EXISTS issues (
+	id         TEXT PRIMARY KEY,
+	owner      TEXT NOT NULL,
+	repo       TEXT NOT NULL,
+	number     INTEGER NOT NULL,
+	title      TEXT NOT NULL,
+	state      TEXT NOT NULL,
+	url        TEXT NOT NULL,
+	author     TEXT NOT NULL,
+	created_at TEXT NOT NULL,
+	updated_at TEXT NOT NULL,
+	closed_at  TEXT,
+	data       TEXT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS issues_repo_number ON issues (owner, repo, number);
+CREATE INDEX IF NOT EXISTS issues_updated_at ON issues (updated_at);
+
+CREATE TABLE IF NOT EXISTS pull_requests (
+	id           TEXT PRIMARY KEY,
+	owner        TEXT NOT NULL,
+	repo         TEXT NOT NULL,
+	number       INTEGER NOT NULL,
+	title        TEXT NOT NULL,
+	state        TEXT NOT NULL,
+	url          TEXT NOT NULL,
+	author       TEXT NOT NULL,
+	base_ref     TEXT NOT NULL,
+	head_ref     TEXT NOT NULL,
+	merge_commit TEXT NOT NULL,
+	created_at   TEXT NOT NULL,
+	updated_at   TEXT NOT NULL,
+	merged_at    TEXT,
+	data         TEXT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS pull_requests_repo_number ON pull_requests (owner, repo, number);
+CREATE INDEX IF NOT EXISTS pull_requests_updated_at ON pull_requests (updated_at);
+
+CREATE TABLE IF NOT EXISTS labels (
+	node_id TEXT NOT NULL,
+	name    TEXT NOT NULL,
+	PRIMARY KEY (node_id, name)
+);
+CREATE INDEX IF NOT EXISTS labels_name ON labels (name);
+
+CREATE TABLE IF NOT EXISTS assignees (
+	issue_id    TEXT NOT NULL,
+	login       TEXT NOT NULL,
+	assigned_at TEXT,
+	PRIMARY KEY (issue_id, login)
+);
+CREATE INDEX IF NOT EXISTS assignees_login ON assignees (login);
+
+CREATE TABLE IF NOT EXISTS timeline_edges (
+	node_id   TEXT NOT NULL,
+	position  INTEGER NOT NULL,
+	type      TEXT NOT NULL,
+	source_id TEXT,
+	PRIMARY KEY (node_id, position)
+);
+CREATE INDEX IF NOT EXISTS timeline_edges_source_id ON timeline_edges (source_id);
+
+CREATE TABLE IF NOT EXISTS closed_by (
+	issue_id TEXT PRIMARY KEY,
+	pr_id    TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS closed_by_pr_id ON closed_by (pr_id);
+
+CREATE TABLE IF NOT EXISTS cherry_picks (
+	pr_id          TEXT NOT NULL,
+	cherry_pick_id TEXT NOT NULL,
+	PRIMARY KEY (pr_id, cherry_pick_id)
+);
+
+CREATE TABLE IF NOT EXISTS sync_state (
+	repo             TEXT PRIMARY KEY,
+	issues_from      TEXT NOT NULL,
+	issues_to        TEXT NOT NULL,
+	pull_requests_to TEXT NOT NULL,
+	checkpoints      TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS meta (
+	key   TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
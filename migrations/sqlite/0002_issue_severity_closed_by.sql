@@ -0,0 +1,5 @@
+-- severity is the level of the severity labels of the config, closed_by the
+-- id of the pr that closed the issue, the same as in the closed_by table.
+ALTER TABLE issues ADD COLUMN severity TEXT;
+ALTER TABLE issues ADD COLUMN closed_by TEXT;
+CREATE INDEX IF NOT EXISTS issues_closed_by ON issues (closed_by);
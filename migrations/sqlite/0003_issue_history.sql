@@ -0,0 +1,11 @@
+-- The versions of the state, labels and assignees of every issue seen across
+-- syncs, labels and assignees are JSON arrays.
+CREATE TABLE IF NOT EXISTS issue_history (
+	issue_id   TEXT NOT NULL,
+	updated_at TEXT NOT NULL,
+	state      TEXT NOT NULL,
+	closed_at  TEXT,
+	labels     TEXT NOT NULL,
+	assignees  TEXT NOT NULL,
+	PRIMARY KEY (issue_id, updated_at)
+);
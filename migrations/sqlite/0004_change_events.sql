@@ -0,0 +1,12 @@
+-- The change events found by the syncs, data is the whole event as JSON.
+CREATE TABLE IF NOT EXISTS change_events (
+	seq         INTEGER PRIMARY KEY,
+	type        TEXT NOT NULL,
+	repo        TEXT NOT NULL,
+	number      INTEGER NOT NULL,
+	at          TEXT NOT NULL,
+	recorded_at TEXT NOT NULL,
+	data        TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS change_events_repo_number ON change_events (repo, number);
+CREATE INDEX IF NOT EXISTS change_events_recorded_at ON change_events (recorded_at);
@@ -0,0 +1,2 @@
+-- How the cherry-pick was found: body, head ref, label or title.
+ALTER TABLE cherry_picks ADD COLUMN reason TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,660 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/shurcooL/githubv4"
+)
+
+// openMySQL connects to the database at dsn, the datetime columns are scanned
+// into time.Time.
+func openMySQL(dsn string) (*sql.DB, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ParseTime = true
+	db, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// challengeRe matches the score and the mentor of a challenge program issue,
+// like "## Score\n- 300\n\n## Mentor\n * @qw4990".
+var challengeRe = regexp.MustCompile(`## Score\s*?-\s*?(\d+)\s*?## Mentor\s*?\* @(\w+)`)
+
+// hintRe matches the hint section of an issue up to the next heading.
+var hintRe = regexp.MustCompile(`(?s)## Hint\s*\n(.*?)(?:\n#{1,2} |\z)`)
+
+// parseChallenge reads the score, mentor and hint of an issue body, the last
+// score and mentor win if the body has several.
+func parseChallenge(body string) (score, mentor, hint string) {
+	strMatches := challengeRe.FindAllStringSubmatch(body, -1)
+	if len(strMatches) != 0 {
+		idx := len(strMatches) - 1
+		score, mentor = strMatches[idx][1], strMatches[idx][2]
+	}
+	if m := hintRe.FindStringSubmatch(body); m != nil {
+		hint = strings.TrimSpace(m[1])
+	}
+	return
+}
+
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// placeholders returns n groups of the given placeholder separated by commas,
+// like "(?, ?), (?, ?)".
+func placeholders(group string, n int) string {
+	return strings.TrimSuffix(strings.Repeat(group+", ", n), ", ")
+}
+
+// updateDatabaseBatch writes issues, their labels, assignees and the pull
+// requests that will close them into the tables of db.sql.
+func updateDatabaseBatch(tx *sql.Tx, issues []IssueNode) error {
+	if len(issues) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, len(issues)*14)
+	for i := range issues {
+		issue := &issues[i]
+		score, mentor, hint := parseChallenge(string(issue.Body))
+		args = append(args, string(issue.Repository.Owner.Login), string(issue.Repository.Name), int(issue.Number),
+			string(issue.Title), string(issue.Author.Login), issue.CreatedAt.Time, issue.UpdatedAt.Time,
+			nullTime(issue.ClosedAt.Time), string(issue.State), string(issue.Url),
+			nullString(score), nullString(mentor), nullString(hint), nullString(config.SeverityOf(issueLabels(issue))))
+	}
+	// closed_by is cleared here and set again once the closers have rows
+	_, err := tx.Exec("insert into issue (owner, repository, number, title, author, created_at, updated_at, closed_at, state, url, score, mentor, hint, severity) values "+
+		placeholders("(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", len(issues))+
+		" on duplicate key update updated_at=values(updated_at), closed_at=values(closed_at), title=values(title), state=values(state), score=values(score), mentor=values(mentor), hint=values(hint), severity=values(severity), closed_by=null",
+		args...)
+	if err != nil {
+		return fmt.Errorf("upsert issues: %v", err)
+	}
+	issueIDs, err := rowIDs(tx, "issue", issueKeys(issues))
+	if err != nil {
+		return err
+	}
+
+	ids := make([]interface{}, 0, len(issueIDs))
+	for _, id := range issueIDs {
+		ids = append(ids, id)
+	}
+	for _, table := range []string{"label", "assignee", "close"} {
+		if _, err := tx.Exec("delete from `"+table+"` where issue_id in ("+placeholders("?", len(ids))+")", ids...); err != nil {
+			return fmt.Errorf("clear %s: %v", table, err)
+		}
+	}
+
+	var labels, assignees []interface{}
+	var prs []PullRequest
+	closes := make(map[NumberKey][]NumberKey)
+	closedBy := make(map[NumberKey]NumberKey)
+	for i := range issues {
+		issue := &issues[i]
+		id := issueIDs[issue.Key()]
+		if closer := closerOf(issue); closer != nil {
+			prs = append(prs, *closer)
+			closedBy[issue.Key()] = closer.Key()
+		}
+		for _, label := range issue.Labels.Nodes {
+			labels = append(labels, id, string(label.Name))
+		}
+		for _, assignee := range issue.Assignees.Nodes {
+			assignees = append(assignees, id, string(assignee.Login), assignee.CreatedAt.Time)
+		}
+		for _, edge := range issue.TimelineItems.Edges {
+			event := edge.Node.CrossReferencedEvent
+			if !event.WillCloseTarget {
+				continue
+			}
+			pr := event.Source.PullRequest
+			if pr.Number == 0 {
+				continue
+			}
+			prs = append(prs, pr)
+			closes[issue.Key()] = append(closes[issue.Key()], pr.Key())
+		}
+	}
+	if len(labels) != 0 {
+		if _, err := tx.Exec("insert ignore into label (issue_id, name) values "+placeholders("(?, ?)", len(labels)/2), labels...); err != nil {
+			return fmt.Errorf("insert labels: %v", err)
+		}
+	}
+	if len(assignees) != 0 {
+		if _, err := tx.Exec("insert ignore into assignee (issue_id, name, created_at) values "+placeholders("(?, ?, ?)", len(assignees)/3), assignees...); err != nil {
+			return fmt.Errorf("insert assignees: %v", err)
+		}
+	}
+	if len(prs) == 0 {
+		return nil
+	}
+
+	args = args[:0]
+	for _, pr := range prs {
+		args = append(args, string(pr.Repository.Owner.Login), string(pr.Repository.Name), int(pr.Number),
+			string(pr.Title), string(pr.Author.Login), pr.CreatedAt.Time, pr.UpdatedAt.Time, string(pr.State), string(pr.Url))
+	}
+	_, err = tx.Exec("insert into pull_request (owner, repository, number, title, author, created_at, updated_at, state, url) values "+
+		placeholders("(?, ?, ?, ?, ?, ?, ?, ?, ?)", len(prs))+
+		" on duplicate key update updated_at=values(updated_at), title=values(title), state=values(state)",
+		args...)
+	if err != nil {
+		return fmt.Errorf("upsert prs: %v", err)
+	}
+	prKeys := make([]NumberKey, 0, len(prs))
+	for _, pr := range prs {
+		prKeys = append(prKeys, pr.Key())
+	}
+	prIDs, err := rowIDs(tx, "pull_request", prKeys)
+	if err != nil {
+		return err
+	}
+	args = args[:0]
+	for issue, linked := range closes {
+		for _, pr := range linked {
+			args = append(args, issueIDs[issue], prIDs[pr])
+		}
+	}
+	if len(args) != 0 {
+		if _, err := tx.Exec("insert into `close` (issue_id, pull_request_id) values "+placeholders("(?, ?)", len(args)/2), args...); err != nil {
+			return fmt.Errorf("insert close: %v", err)
+		}
+	}
+	for issue, pr := range closedBy {
+		if _, err := tx.Exec("update issue set closed_by = ? where id = ?", prIDs[pr], issueIDs[issue]); err != nil {
+			return fmt.Errorf("set closed_by: %v", err)
+		}
+	}
+	return nil
+}
+
+func issueKeys(issues []IssueNode) []NumberKey {
+	keys := make([]NumberKey, 0, len(issues))
+	for i := range issues {
+		keys = append(keys, issues[i].Key())
+	}
+	return keys
+}
+
+// rowIDs looks up the auto increment ids of the rows of table with the given
+// keys, LastInsertId tells only the first one of a batch.
+func rowIDs(tx *sql.Tx, table string, keys []NumberKey) (map[NumberKey]int64, error) {
+	args := make([]interface{}, 0, len(keys)*3)
+	for _, key := range keys {
+		parts := strings.SplitN(key.Repo, "/", 2)
+		args = append(args, parts[0], parts[1], key.Number)
+	}
+	rows, err := tx.Query("select id, owner, repository, number from `"+table+"` where (owner, repository, number) in ("+placeholders("(?, ?, ?)", len(keys))+")", args...)
+	if err != nil {
+		return nil, fmt.Errorf("look up %s ids: %v", table, err)
+	}
+	defer rows.Close()
+	ids := make(map[NumberKey]int64, len(keys))
+	for rows.Next() {
+		var id int64
+		var owner, repo string
+		var number int
+		if err := rows.Scan(&id, &owner, &repo, &number); err != nil {
+			return nil, err
+		}
+		ids[NumberKey{Repo: repoKey(owner, repo), Number: number}] = id
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if _, ok := ids[key]; !ok {
+			return nil, fmt.Errorf("no %s row of %s#%d after upsert", table, key.Repo, key.Number)
+		}
+	}
+	return ids, nil
+}
+
+// MySQLStore keeps the archive in MySQL, the issues are written to the tables
+// of db.sql as well so the report reads them from there. The schema comes from
+// the migrations under migrations/mysql.
+type MySQLStore struct {
+	db *sql.DB
+	// lock is the connection holding the named lock of the database from Lock
+	// to Unlock, MySQL releases it with the session.
+	lock *sql.Conn
+}
+
+func OpenMySQLStore(dsn string) (*MySQLStore, error) {
+	db, err := openMySQL(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := prepareSchema(db, storageMySQL); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &MySQLStore{db: db}, nil
+}
+
+// mysqlLock names the lock of the runs sharing a database, named locks are
+// server wide so the database is part of it.
+const mysqlLock = "CONCAT('issue-tracker.', DATABASE())"
+
+// getLock takes the named lock of the database on a connection of its own,
+// waiting up to timeout seconds, forever if negative. It tells whether it got
+// the lock in time.
+func (s *MySQLStore) getLock(timeout int) (bool, error) {
+	if s.lock != nil {
+		return true, nil
+	}
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	var got sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK("+mysqlLock+", ?)", timeout).Scan(&got); err != nil {
+		conn.Close()
+		return false, fmt.Errorf("lock the database: %v", err)
+	}
+	if !got.Valid {
+		conn.Close()
+		return false, fmt.Errorf("lock the database: GET_LOCK failed")
+	}
+	if got.Int64 != 1 {
+		conn.Close()
+		return false, nil
+	}
+	s.lock = conn
+	return true, nil
+}
+
+// Lock takes the named lock of the database, a run finding it held waits for
+// the other one to finish like with the lock file of the other storages.
+func (s *MySQLStore) Lock() error {
+	locked, err := s.getLock(0)
+	if err != nil || locked {
+		return err
+	}
+	start := time.Now()
+	log.Printf("database is locked by another run, waiting")
+	if _, err := s.getLock(-1); err != nil {
+		return err
+	}
+	log.Printf("got the lock of the database after %v", time.Now().Sub(start))
+	return nil
+}
+
+func (s *MySQLStore) TryLock() (bool, error) {
+	return s.getLock(0)
+}
+
+func (s *MySQLStore) Unlock() error {
+	if s.lock == nil {
+		return nil
+	}
+	_, err := s.lock.ExecContext(context.Background(), "DO RELEASE_LOCK("+mysqlLock+")")
+	if closeErr := s.lock.Close(); err == nil {
+		err = closeErr
+	}
+	s.lock = nil
+	return err
+}
+
+func (s *MySQLStore) Close() error {
+	s.Unlock()
+	return s.db.Close()
+}
+
+func (s *MySQLStore) Load(a *Archive) error {
+	start := time.Now()
+	var issues []IssueNode
+	var prs []PullRequest
+	rows, err := s.db.Query("select id, kind, data from archive_node order by updated_at desc")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, kind string
+		var data []byte
+		if err := rows.Scan(&id, &kind, &data); err != nil {
+			return err
+		}
+		if kind == "ISSUE" {
+			var issue IssueNode
+			if err := json.Unmarshal(data, &issue); err != nil {
+				a.broken = append(a.broken, brokenNode{kind: nodeKindIssue, id: id, where: "archive_node " + id, err: err})
+				continue
+			}
+			issues = append(issues, issue)
+		} else {
+			var pr PullRequest
+			if err := json.Unmarshal(data, &pr); err != nil {
+				a.broken = append(a.broken, brokenNode{kind: nodeKindPullRequest, id: id, where: "archive_node " + id, err: err})
+				continue
+			}
+			prs = append(prs, pr)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	a.Issues.issues = issues
+	a.Issues.reindex()
+	a.PullRequests.prs = prs
+	a.PullRequests.reindex()
+	log.Printf("load %d issues and %d prs", len(issues), len(prs))
+	if err := loadHistory(s.db, a.Issues); err != nil {
+		return err
+	}
+	events, err := loadEvents(s.db, "change_event")
+	if err != nil {
+		return err
+	}
+	var seen int64
+	if err := s.db.QueryRow("select value from meta where `key` = 'events_seen'").Scan(&seen); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	a.Events.setLoaded(events, seen)
+
+	st := a.Sync
+	st.Repositories = make(map[string]*RepoSyncState)
+	srows, err := s.db.Query("select repo, data from sync_state")
+	if err != nil {
+		return err
+	}
+	defer srows.Close()
+	for srows.Next() {
+		var repo string
+		var data []byte
+		rs := &RepoSyncState{}
+		if err := srows.Scan(&repo, &data); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, rs); err != nil {
+			return fmt.Errorf("sync state of %s: %v", repo, err)
+		}
+		st.Repositories[repo] = rs
+	}
+	if err := srows.Err(); err != nil {
+		return err
+	}
+	var discovered []byte
+	err = s.db.QueryRow("select value from meta where `key` = 'discovered'").Scan(&discovered)
+	if err == sql.ErrNoRows {
+		err = nil
+	} else if err == nil {
+		err = json.Unmarshal(discovered, &st.Discovered)
+	}
+	log.Printf("data loaded in %v", time.Now().Sub(start))
+	return err
+}
+
+// Save writes the nodes in batches, each in a transaction of its own, the
+// issues go to the tables of db.sql as well.
+func (s *MySQLStore) Save(a *Archive, issues []IssueNode, prs []PullRequest, events []ChangeEvent) error {
+	batch := config.Batch.Database
+	for i := 0; i < len(issues); i += batch {
+		end := i + batch
+		if end > len(issues) {
+			end = len(issues)
+		}
+		err := s.write(func(tx *sql.Tx) error {
+			nodes := make([]archiveNode, 0, end-i)
+			for k := range issues[i:end] {
+				issue := &issues[i+k]
+				nodes = append(nodes, archiveNode{kind: "ISSUE", id: issue.ID, key: issue.Key(), updatedAt: issue.UpdatedAt.Time, node: issue})
+			}
+			if err := upsertArchiveNodes(tx, nodes); err != nil {
+				return err
+			}
+			if err := saveHistory(tx, a.Issues, issues[i:end]); err != nil {
+				return err
+			}
+			return updateDatabaseBatch(tx, issues[i:end])
+		})
+		if err != nil {
+			return fmt.Errorf("batch of issues %d to %d: %v", i, end, err)
+		}
+	}
+	for i := 0; i < len(prs); i += batch {
+		end := i + batch
+		if end > len(prs) {
+			end = len(prs)
+		}
+		err := s.write(func(tx *sql.Tx) error {
+			nodes := make([]archiveNode, 0, end-i)
+			for k := range prs[i:end] {
+				pr := &prs[i+k]
+				nodes = append(nodes, archiveNode{kind: "PULL_REQUEST", id: pr.ID, key: pr.Key(), updatedAt: pr.UpdatedAt.Time, node: pr})
+			}
+			if err := upsertArchiveNodes(tx, nodes); err != nil {
+				return err
+			}
+			return saveCherryPicks(tx, prs[i:end])
+		})
+		if err != nil {
+			return fmt.Errorf("batch of prs %d to %d: %v", i, end, err)
+		}
+	}
+	return s.write(func(tx *sql.Tx) error {
+		repos, discovered := a.Sync.snapshot()
+		for repo, rs := range repos {
+			data, err := json.Marshal(rs)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec("insert into sync_state (repo, data) values (?, ?) on duplicate key update data=values(data)", repo, data); err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(discovered)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("insert into meta (`key`, value) values ('discovered', ?) on duplicate key update value=values(value)", data)
+		if err != nil {
+			return err
+		}
+		if err := saveEvents(tx, "change_event", events); err != nil {
+			return err
+		}
+		a.Events.mu.Lock()
+		seen := a.Events.Seen
+		a.Events.mu.Unlock()
+		_, err = tx.Exec("insert into meta (`key`, value) values ('events_seen', ?) on duplicate key update value=values(value)", seen)
+		return err
+	})
+}
+
+// Delete removes the archive nodes and history of the issues and pull
+// requests, and the rows of the issues in the tables of db.sql. The rows of
+// the pull requests stay there, the issues kept may still refer to them.
+// InnoDB reuses the pages freed rather than shrinking its files.
+func (s *MySQLStore) Delete(a *Archive, issues []IssueNode, prs []PullRequest) error {
+	batch := config.Batch.Database
+	for i := 0; i < len(issues); i += batch {
+		end := i + batch
+		if end > len(issues) {
+			end = len(issues)
+		}
+		err := s.write(func(tx *sql.Tx) error {
+			ids := make([]interface{}, 0, end-i)
+			keys := make([]interface{}, 0, (end-i)*3)
+			for k := range issues[i:end] {
+				issue := &issues[i+k]
+				ids = append(ids, nodeID(issue.ID))
+				keys = append(keys, string(issue.Repository.Owner.Login), string(issue.Repository.Name), int(issue.Number))
+			}
+			in := "(" + placeholders("?", len(ids)) + ")"
+			if _, err := tx.Exec("delete from archive_node where id in "+in, ids...); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("delete from issue_history where issue_id in "+in, ids...); err != nil {
+				return err
+			}
+			rows := "(select id from issue where (owner, repository, number) in (" + placeholders("(?, ?, ?)", len(ids)) + "))"
+			for _, table := range []string{"label", "assignee", "close"} {
+				if _, err := tx.Exec("delete from `"+table+"` where issue_id in "+rows, keys...); err != nil {
+					return fmt.Errorf("clear %s: %v", table, err)
+				}
+			}
+			_, err := tx.Exec("delete from issue where (owner, repository, number) in ("+placeholders("(?, ?, ?)", len(ids))+")", keys...)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("delete issues %d to %d: %v", i, end, err)
+		}
+	}
+	for i := 0; i < len(prs); i += batch {
+		end := i + batch
+		if end > len(prs) {
+			end = len(prs)
+		}
+		ids := make([]interface{}, 0, end-i)
+		for k := range prs[i:end] {
+			ids = append(ids, nodeID(prs[i+k].ID))
+		}
+		in := "(" + placeholders("?", len(ids)) + ")"
+		err := s.write(func(tx *sql.Tx) error {
+			if _, err := tx.Exec("delete from archive_node where id in "+in, ids...); err != nil {
+				return err
+			}
+			_, err := tx.Exec("delete from cherry_pick where pr_id in "+in, ids...)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("delete prs %d to %d: %v", i, end, err)
+		}
+	}
+	if first := a.Events.first(); first != 0 {
+		if _, err := s.db.Exec("delete from change_event where seq < ?", first); err != nil {
+			return fmt.Errorf("delete change events: %v", err)
+		}
+	}
+	return nil
+}
+
+// Size sums the data and indexes of the tables in the database.
+func (s *MySQLStore) Size() (int64, error) {
+	var size int64
+	err := s.db.QueryRow("select coalesce(sum(data_length + index_length), 0) from information_schema.tables where table_schema = database()").Scan(&size)
+	return size, err
+}
+
+func (s *MySQLStore) write(f func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+type archiveNode struct {
+	kind      string
+	id        githubv4.ID
+	key       NumberKey
+	updatedAt time.Time
+	node      interface{}
+}
+
+func upsertArchiveNodes(tx *sql.Tx, nodes []archiveNode) error {
+	if len(nodes) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, len(nodes)*7)
+	for _, n := range nodes {
+		data, err := json.Marshal(n.node)
+		if err != nil {
+			return err
+		}
+		parts := strings.SplitN(n.key.Repo, "/", 2)
+		args = append(args, nodeID(n.id), n.kind, parts[0], parts[1], n.key.Number, n.updatedAt, data)
+	}
+	_, err := tx.Exec("insert into archive_node (id, kind, owner, repository, number, updated_at, data) values "+
+		placeholders("(?, ?, ?, ?, ?, ?, ?)", len(nodes))+
+		" on duplicate key update owner=values(owner), repository=values(repository), number=values(number), updated_at=values(updated_at), data=values(data)",
+		args...)
+	if err != nil {
+		return fmt.Errorf("upsert archive nodes: %v", err)
+	}
+	return nil
+}
+
+// saveCherryPicks replaces the cherry-picks of prs along with how each was
+// found.
+func saveCherryPicks(tx *sql.Tx, prs []PullRequest) error {
+	if len(prs) == 0 {
+		return nil
+	}
+	ids := make([]interface{}, 0, len(prs))
+	var args []interface{}
+	for i := range prs {
+		id := nodeID(prs[i].ID)
+		ids = append(ids, id)
+		for _, cp := range cherryPicksOf(&prs[i]) {
+			args = append(args, id, nodeID(cp.PR.ID), cp.Reason)
+		}
+	}
+	if _, err := tx.Exec("delete from cherry_pick where pr_id in ("+placeholders("?", len(ids))+")", ids...); err != nil {
+		return fmt.Errorf("clear cherry-picks: %v", err)
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	_, err := tx.Exec("insert ignore into cherry_pick (pr_id, cherry_pick_id, reason) values "+placeholders("(?, ?, ?)", len(args)/3), args...)
+	if err != nil {
+		return fmt.Errorf("insert cherry-picks: %v", err)
+	}
+	return nil
+}
+
+// ReportIssues reads the issues from the tables of db.sql.
+func (s *MySQLStore) ReportIssues(a *Archive, labels []string) ([]Issue, error) {
+	db := DB{s.db}
+	issues, err := db.GetIssues("OPEN", labels)
+	if err != nil {
+		return nil, err
+	}
+	for k := range issues {
+		i := &issues[k]
+		if i.Labels, err = db.GetIssueLabelsByID(i.ID); err != nil {
+			return nil, err
+		}
+		if i.Assignees, err = db.GetIssueAssigneesByID(i.ID); err != nil {
+			return nil, err
+		}
+		if i.LinkedPRs, err = db.GetIssueLinkedPRsByID(i.ID); err != nil {
+			return nil, err
+		}
+	}
+	return issues, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/shurcooL/githubv4"
+)
+
+// followUpBatch is the page size of the follow-up queries fetching the rest of
+// a nested connection.
+const followUpBatch = 100
+
+// completeIssue fetches the labels, assignees and timeline items of issue that
+// didn't fit in the first page, and the timeline items of its closers, it
+// tells how many connections were truncated.
+func completeIssue(issue *IssueNode) (truncated int, err error) {
+	if issue.Labels.PageInfo.HasNextPage {
+		truncated++
+		if err = completeIssueLabels(issue); err != nil {
+			return
+		}
+	}
+	if issue.Assignees.PageInfo.HasNextPage {
+		truncated++
+		if err = completeIssueAssignees(issue); err != nil {
+			return
+		}
+	}
+	if issue.TimelineItems.PageInfo.HasNextPage {
+		truncated++
+		if err = completeIssueTimeline(issue); err != nil {
+			return
+		}
+	}
+	// the closers are tracked from here as they are, a closer in another
+	// repository is never fetched on its own to have its cherry-picks
+	for i := range issue.TimelineItems.Edges {
+		closer := &issue.TimelineItems.Edges[i].Node.ClosedEvent.Closer.PullRequest
+		if closer.Number == 0 {
+			continue
+		}
+		var n int
+		if n, err = completePullRequest(closer); err != nil {
+			return
+		}
+		truncated += n
+	}
+	return
+}
+
+func completeIssueLabels(issue *IssueNode) error {
+	var query struct {
+		RateLimited
+		Node struct {
+			Issue struct {
+				Labels struct {
+					PageInfo PageInfo
+					Nodes    []Label
+				} `graphql:"labels(first: $limit, after: $cursor)"`
+			} `graphql:"... on Issue"`
+		} `graphql:"node(id: $id)"`
+	}
+	for issue.Labels.PageInfo.HasNextPage {
+		param := map[string]interface{}{
+			"id":     issue.ID,
+			"limit":  githubv4.Int(followUpBatch),
+			"cursor": issue.Labels.PageInfo.EndCursor,
+		}
+		if err := client.Query(context.Background(), &query, param); err != nil {
+			return err
+		}
+		labels := query.Node.Issue.Labels
+		issue.Labels.Nodes = append(issue.Labels.Nodes, labels.Nodes...)
+		issue.Labels.PageInfo = labels.PageInfo
+	}
+	return nil
+}
+
+func completeIssueAssignees(issue *IssueNode) error {
+	var query struct {
+		RateLimited
+		Node struct {
+			Issue struct {
+				Assignees struct {
+					PageInfo PageInfo
+					Nodes    []IssueAssignee
+				} `graphql:"assignees(first: $limit, after: $cursor)"`
+			} `graphql:"... on Issue"`
+		} `graphql:"node(id: $id)"`
+	}
+	for issue.Assignees.PageInfo.HasNextPage {
+		param := map[string]interface{}{
+			"id":     issue.ID,
+			"limit":  githubv4.Int(followUpBatch),
+			"cursor": issue.Assignees.PageInfo.EndCursor,
+		}
+		if err := client.Query(context.Background(), &query, param); err != nil {
+			return err
+		}
+		assignees := query.Node.Issue.Assignees
+		issue.Assignees.Nodes = append(issue.Assignees.Nodes, assignees.Nodes...)
+		issue.Assignees.PageInfo = assignees.PageInfo
+	}
+	return nil
+}
+
+func completeIssueTimeline(issue *IssueNode) error {
+	var query struct {
+		RateLimited
+		Node struct {
+			Issue struct {
+				TimelineItems struct {
+					PageInfo PageInfo
+					Edges    []IssueTimelineItem
+				} `graphql:"timelineItems(first: $limit, after: $cursor, itemTypes: [CROSS_REFERENCED_EVENT, CLOSED_EVENT] )"`
+			} `graphql:"... on Issue"`
+		} `graphql:"node(id: $id)"`
+	}
+	for issue.TimelineItems.PageInfo.HasNextPage {
+		// timeline items embed whole pull requests, keep the pages small
+		param := map[string]interface{}{
+			"id":     issue.ID,
+			"limit":  githubv4.Int(20),
+			"cursor": issue.TimelineItems.PageInfo.EndCursor,
+		}
+		if err := client.Query(context.Background(), &query, param); err != nil {
+			return err
+		}
+		items := query.Node.Issue.TimelineItems
+		issue.TimelineItems.Edges = append(issue.TimelineItems.Edges, items.Edges...)
+		issue.TimelineItems.PageInfo = items.PageInfo
+	}
+	return nil
+}
+
+// completePullRequest fetches the timeline items of pr that didn't fit in the
+// first page, it tells how many connections were truncated.
+func completePullRequest(pr *PullRequest) (truncated int, err error) {
+	if !pr.TimelineItems.PageInfo.HasNextPage {
+		return
+	}
+	truncated++
+	var query struct {
+		RateLimited
+		Node struct {
+			PullRequest struct {
+				TimelineItems struct {
+					PageInfo PageInfo
+					Edges    []PullRequestTimelineItem
+				} `graphql:"timelineItems(first: $limit, after: $cursor, itemTypes: [CROSS_REFERENCED_EVENT, ISSUE_COMMENT] )"`
+			} `graphql:"... on PullRequest"`
+		} `graphql:"node(id: $id)"`
+	}
+	for pr.TimelineItems.PageInfo.HasNextPage {
+		param := map[string]interface{}{
+			"id":     pr.ID,
+			"limit":  githubv4.Int(50),
+			"cursor": pr.TimelineItems.PageInfo.EndCursor,
+		}
+		if err = client.Query(context.Background(), &query, param); err != nil {
+			return
+		}
+		items := query.Node.PullRequest.TimelineItems
+		pr.TimelineItems.Edges = append(pr.TimelineItems.Edges, items.Edges...)
+		pr.TimelineItems.PageInfo = items.PageInfo
+	}
+	return
+}
+
+// completeIssues completes every issue of a fetched page in place, it tells
+// how many connections were truncated.
+func completeIssues(issues []IssueNode) (truncated int, err error) {
+	for i := range issues {
+		n, err := completeIssue(&issues[i])
+		if err != nil {
+			log.Printf("failed to complete issue %d: %v", issues[i].Number, err)
+			return truncated, err
+		}
+		if n != 0 {
+			log.Printf("completed %d truncated connections of issue %d", n, issues[i].Number)
+		}
+		truncated += n
+	}
+	return
+}
+
+// completePullRequests completes every pull request of a fetched page in
+// place, it tells how many connections were truncated.
+func completePullRequests(prs []PullRequest) (truncated int, err error) {
+	for i := range prs {
+		n, err := completePullRequest(&prs[i])
+		if err != nil {
+			log.Printf("failed to complete pull request %d: %v", prs[i].Number, err)
+			return truncated, err
+		}
+		if n != 0 {
+			log.Printf("completed the truncated timeline of pull request %d", prs[i].Number)
+		}
+		truncated += n
+	}
+	return
+}
@@ -0,0 +1,48 @@
+package main
+
+import "sync"
+
+// pool runs jobs on a bounded number of goroutines.
+type pool struct {
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+func newPool(workers int) *pool {
+	if workers < 1 {
+		workers = 1
+	}
+	return &pool{sem: make(chan struct{}, workers)}
+}
+
+// Go runs job once a worker is free, jobs given after one failed are skipped.
+func (p *pool) Go(job func() error) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.sem <- struct{}{}
+		defer func() { <-p.sem }()
+		p.mu.Lock()
+		failed := p.err != nil
+		p.mu.Unlock()
+		if failed {
+			return
+		}
+		if err := job(); err != nil {
+			p.mu.Lock()
+			if p.err == nil {
+				p.err = err
+			}
+			p.mu.Unlock()
+		}
+	}()
+}
+
+// Wait waits for all the jobs and returns the first error of them.
+func (p *pool) Wait() error {
+	p.wg.Wait()
+	return p.err
+}
@@ -1,18 +1,28 @@
 package main
 
 import (
+	"archive/zip"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"regexp"
 	"sort"
-	"strings"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/shurcooL/githubv4"
 )
 
-func getPullRequestsFrom(owner, name string, from time.Time, batchLimit int, totalLimit int) (prs []PullRequest, err error) {
+// getPullRequestsFrom fetches the pull requests in descending order of their
+// updated time until passing from. It starts after cursor if given, and calls
+// onPage if given after every page with the cursor of its last pull request.
+func getPullRequestsFrom(owner, name string, from time.Time, batchLimit int, totalLimit int, cursor *githubv4.String, onPage func(page []PullRequest, cursor githubv4.String) error) (prs []PullRequest, err error) {
 	var query struct {
+		RateLimited
 		Repository struct {
 			PullRequests struct {
 				Edges []struct {
@@ -23,8 +33,8 @@ func getPullRequestsFrom(owner, name string, from time.Time, batchLimit int, tot
 		} `graphql:"repository(name: $name, owner: $owner)"`
 	}
 
-	cursor := (*githubv4.String)(nil)
 	total := 0
+	truncated := 0
 
 	since := from.Add(-1 * time.Minute)
 	log.Printf("fetching since %s", since)
@@ -47,10 +57,20 @@ func getPullRequestsFrom(owner, name string, from time.Time, batchLimit int, tot
 			return
 		}
 		edges := query.Repository.PullRequests.Edges
-
+		page := make([]PullRequest, 0, len(edges))
 		for _, edge := range edges {
-			prs = append(prs, edge.Node)
-			log.Printf("%06d %s %s\n", edge.Node.Number, edge.Node.UpdatedAt.Format(time.RFC3339), edge.Node.Title)
+			page = append(page, edge.Node)
+		}
+		var n int
+		n, err = completePullRequests(page)
+		if err != nil {
+			return
+		}
+		truncated += n
+
+		for _, pr := range page {
+			prs = append(prs, pr)
+			log.Printf("%06d %s %s\n", pr.Number, pr.UpdatedAt.Format(time.RFC3339), pr.Title)
 		}
 
 		cnt := len(edges)
@@ -61,6 +81,11 @@ func getPullRequestsFrom(owner, name string, from time.Time, batchLimit int, tot
 			total += cnt
 			totalLimit -= cnt
 			log.Println(cnt, "fetced", owner, name, lastUpdated)
+			if onPage != nil {
+				if err = onPage(page, lastIssue.Cursor); err != nil {
+					return
+				}
+			}
 			if since.After(lastUpdated) {
 				break
 			}
@@ -70,70 +95,353 @@ func getPullRequestsFrom(owner, name string, from time.Time, batchLimit int, tot
 		}
 	}
 
-	log.Printf("fetched %d pull requests from %s/%s\n", total, owner, name)
+	log.Printf("fetched %d pull requests from %s/%s, completed %d truncated timelines\n", total, owner, name, truncated)
+	return
+}
+
+// searchLimit is the most results the search API serves for a query.
+const searchLimit = 1000
+
+// errTooManyResults is returned for a search range matching more than
+// searchLimit results, it has to be fetched in narrower ranges.
+var errTooManyResults = errors.New("more results than the search serves")
+
+// getPullRequestsByTimeRange fetches the pull requests of a repository updated
+// from from to to through the search API. A range matching more than
+// searchLimit of them fails with errTooManyResults before anything is fetched,
+// unless it is too narrow to be split. It starts after cursor if given, and
+// calls onPage if given after every page with the cursor of its last pull
+// request.
+func getPullRequestsByTimeRange(owner, name string, from, to time.Time, batchLimit int, cursor *githubv4.String, onPage func(page []PullRequest, cursor githubv4.String) error) (prs []PullRequest, err error) {
+	var query struct {
+		RateLimited
+		Search struct {
+			IssueCount githubv4.Int
+			Edges      []struct {
+				Cursor githubv4.String
+				Node   struct {
+					PullRequest PullRequest `graphql:"... on PullRequest"`
+				}
+			}
+		} `graphql:"search(query: $query, type: ISSUE, first: $limit, after: $cursor)"`
+	}
+
+	q := fmt.Sprintf("repo:%s/%s is:pr updated:%s..%s sort:updated-asc", owner, name, from.UTC().Format(time.RFC3339), to.UTC().Format(time.RFC3339))
+	log.Printf("searching %s", q)
+	total := 0
+	truncated := 0
+	for {
+		param := map[string]interface{}{
+			"query":  githubv4.String(q),
+			"limit":  githubv4.Int(batchLimit),
+			"cursor": cursor,
+		}
+		err = client.Query(context.Background(), &query, param)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if total == 0 && query.Search.IssueCount > searchLimit {
+			if to.Sub(from) >= 2*time.Second {
+				log.Printf("%d pull requests match %s", query.Search.IssueCount, q)
+				return nil, errTooManyResults
+			}
+			log.Printf("%d pull requests match %s, only the first %d are served", query.Search.IssueCount, q, searchLimit)
+		}
+		edges := query.Search.Edges
+		page := make([]PullRequest, 0, len(edges))
+		for _, edge := range edges {
+			page = append(page, edge.Node.PullRequest)
+		}
+		var n int
+		n, err = completePullRequests(page)
+		if err != nil {
+			return
+		}
+		truncated += n
+		for _, pr := range page {
+			prs = append(prs, pr)
+			log.Printf("%06d %s %s\n", pr.Number, pr.UpdatedAt.Format(time.RFC3339), pr.Title)
+		}
+
+		cnt := len(edges)
+		total += cnt
+		if cnt != 0 {
+			cursor = &edges[cnt-1].Cursor
+			if onPage != nil {
+				if err = onPage(page, *cursor); err != nil {
+					return
+				}
+			}
+		}
+		if cnt != batchLimit {
+			break
+		}
+	}
+
+	log.Printf("fetched %d pull requests from %s/%s, completed %d truncated timelines\n", total, owner, name, truncated)
 	return
 }
 
 type TrackedPullRequests struct {
+	// mu guards the pull requests against the sync workers adding to them.
+	mu             sync.Mutex
 	prs            []PullRequest
 	idMap          IDMap
-	cherryPickedTo map[githubv4.ID][]githubv4.ID
+	numberMap      map[NumberKey]int
+	cherryPickedTo map[githubv4.ID][]cherryPick
+	// dirty keeps the pull requests added or updated since the last save.
+	dirty map[githubv4.ID]bool
+	// events keeps the changes found by add until the archive logs them.
+	events []ChangeEvent
+}
+
+func (pr *PullRequestWithoutTimelineItems) Key() NumberKey {
+	return NumberKey{Repo: pr.Repository.Key(), Number: int(pr.Number)}
+}
+
+// Load decodes the pull requests of r, like TrackedIssues.Load.
+func (t *TrackedPullRequests) Load(r io.Reader, where string, ndjson bool) ([]brokenNode, error) {
+	var broken []brokenNode
+	err := decodeNodes(r, where, ndjson, func(data []byte, where string) {
+		var pr PullRequest
+		if err := json.Unmarshal(data, &pr); err != nil {
+			broken = append(broken, newBrokenNode(nodeKindPullRequest, where, data, err))
+			return
+		}
+		t.prs = append(t.prs, pr)
+	})
+	return broken, err
 }
 
-func (t *TrackedPullRequests) Load(data []byte) {
-	json.Unmarshal(data, &t.prs)
-	log.Printf("load %d prs", len(t.prs))
+// byID looks up a tracked pull request by its node id.
+func (t *TrackedPullRequests) byID(id githubv4.ID) (*PullRequest, bool) {
+	i, ok := t.idMap[id]
+	if !ok {
+		return nil, false
+	}
+	return &t.prs[i], true
+}
+
+func (t *TrackedPullRequests) reindex() {
 	t.idMap = make(IDMap)
-	for i, pr := range t.prs {
-		t.idMap[pr.ID] = i
+	t.numberMap = make(map[NumberKey]int)
+	for i := range t.prs {
+		t.idMap[t.prs[i].ID] = i
+		t.numberMap[t.prs[i].Key()] = i
 	}
 }
 
+// Get looks up a tracked pull request by its repository and number.
+func (t *TrackedPullRequests) Get(repo string, number int) (*PullRequest, bool) {
+	i, ok := t.numberMap[NumberKey{Repo: repo, Number: number}]
+	if !ok {
+		return nil, false
+	}
+	return &t.prs[i], true
+}
+
 func (ti *TrackedPullRequests) Normalize() {
 	sort.Slice(ti.prs, func(i, j int) bool {
 		return ti.prs[i].UpdatedAt.Time.After(ti.prs[j].UpdatedAt.Time)
 	})
-	for i, pr := range ti.prs {
-		ti.idMap[pr.ID] = i
-	}
+	ti.reindex()
 }
 
-func (ti *TrackedPullRequests) Save() []byte {
+func (ti *TrackedPullRequests) Save(zw *zip.Writer, kept map[string][][]byte) error {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
 	ti.Normalize()
-	issuesJson, err := json.MarshalIndent(ti.prs, "", "\t")
-	if err != nil {
-		log.Println(err)
-	}
-	return issuesJson
+	return writeShards(zw, archivePRsDir, len(ti.prs),
+		func(i int) time.Time { return ti.prs[i].CreatedAt.Time },
+		func(i int) interface{} { return &ti.prs[i] }, kept)
 }
 
-func (t *TrackedPullRequests) add(pr PullRequest) {
+// add merges pr, it tells whether pr was not tracked before and whether it
+// replaced an older version. A pr not tracked before logs its cherry-picks
+// unless it was found in the past.
+func (t *TrackedPullRequests) add(pr PullRequest, past bool) (added bool, updated bool) {
+	if t.idMap == nil {
+		t.reindex()
+	}
 	if i, ok := t.idMap[pr.ID]; ok {
 		if pr.UpdatedAt.Time.After(t.prs[i].UpdatedAt.Time) {
+			t.events = append(t.events, diffPullRequest(&t.prs[i], &pr)...)
 			t.prs[i] = pr
+			t.markDirty(pr.ID)
+			updated = true
 		}
+		return
+	}
+	t.idMap[pr.ID] = len(t.prs)
+	t.numberMap[pr.Key()] = len(t.prs)
+	t.prs = append(t.prs, pr)
+	if !past {
+		t.events = append(t.events, diffPullRequest(nil, &pr)...)
+	}
+	t.markDirty(pr.ID)
+	added = true
+	return
+}
+
+// addStub tracks pr, a closer or cherry-pick found in the timeline of another
+// node, if it isn't tracked yet. It logs no events, the stub is neither opened
+// nor changed by being found, and never replaces a tracked version, whose
+// timeline the stub lacks; the syncs fetch its changes whole.
+func (t *TrackedPullRequests) addStub(pr PullRequest) {
+	if t.idMap == nil {
+		t.reindex()
+	}
+	if _, ok := t.idMap[pr.ID]; ok {
+		return
+	}
+	t.idMap[pr.ID] = len(t.prs)
+	t.numberMap[pr.Key()] = len(t.prs)
+	t.prs = append(t.prs, pr)
+	t.markDirty(pr.ID)
+}
+
+// Replace tracks pr in place of the tracked version whatever their updated
+// times, for fsck -repair to put back what GitHub has.
+func (t *TrackedPullRequests) Replace(pr PullRequest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.idMap == nil {
+		t.reindex()
+	}
+	if i, ok := t.idMap[pr.ID]; ok {
+		t.prs[i] = pr
 	} else {
 		t.idMap[pr.ID] = len(t.prs)
+		t.numberMap[pr.Key()] = len(t.prs)
 		t.prs = append(t.prs, pr)
 	}
+	t.markDirty(pr.ID)
+}
+
+// dedupe keeps the latest version of the pull requests stored more than once,
+// it returns how many were dropped.
+func (t *TrackedPullRequests) dedupe() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	latest := make(map[githubv4.ID]int)
+	kept := t.prs[:0]
+	for _, pr := range t.prs {
+		if k, ok := latest[pr.ID]; ok {
+			if pr.UpdatedAt.Time.After(kept[k].UpdatedAt.Time) {
+				kept[k] = pr
+			}
+			t.markDirty(pr.ID)
+			continue
+		}
+		latest[pr.ID] = len(kept)
+		kept = append(kept, pr)
+	}
+	dropped := len(t.prs) - len(kept)
+	t.prs = kept
+	t.reindex()
+	return dropped
 }
 
-func (t *TrackedPullRequests) Add(prs []PullRequest) {
+// drop removes the pull requests of ids, it returns the ones removed.
+func (t *TrackedPullRequests) drop(ids map[githubv4.ID]bool) (dropped []PullRequest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+	kept := make([]PullRequest, 0, len(t.prs))
+	for _, pr := range t.prs {
+		if !ids[pr.ID] {
+			kept = append(kept, pr)
+			continue
+		}
+		dropped = append(dropped, pr)
+		delete(t.dirty, pr.ID)
+		delete(t.cherryPickedTo, pr.ID)
+	}
+	t.prs = kept
+	t.reindex()
+	return
+}
+
+func (t *TrackedPullRequests) markDirty(id githubv4.ID) {
+	if t.dirty == nil {
+		t.dirty = make(map[githubv4.ID]bool)
+	}
+	t.dirty[id] = true
+}
+
+// takeDirty returns the pull requests changed since the last call.
+func (t *TrackedPullRequests) takeDirty() []PullRequest {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	prs := make([]PullRequest, 0, len(t.dirty))
+	for id := range t.dirty {
+		prs = append(prs, t.prs[t.idMap[id]])
+	}
+	t.dirty = nil
+	return prs
+}
+
+// takeEvents returns the changes found since the last call.
+func (t *TrackedPullRequests) takeEvents() []ChangeEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	events := t.events
+	t.events = nil
+	return events
+}
+
+// Add merges the updated pull requests, it returns how many of them were not
+// tracked before and how many replaced an older version.
+func (t *TrackedPullRequests) Add(prs []PullRequest) (added int, updated int) {
+	return t.merge(prs, false)
+}
+
+// merge is Add, like TrackedIssues.merge.
+func (t *TrackedPullRequests) merge(prs []PullRequest, past bool) (added int, updated int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	for _, pr := range prs {
-		t.add(pr)
+		a, u := t.add(pr, past)
+		if a {
+			added++
+		}
+		if u {
+			updated++
+		}
 	}
+	return
 }
 
-func (ti *TrackedPullRequests) getUpdateTimeRange() (from time.Time, to time.Time) {
-	if len(ti.prs) == 0 {
-		// if we don't have any tracked things, we initialize from 2 days ago
-		from = time.Now().Add(-48 * time.Hour)
-		to = from
-		return
+// tracks tells whether a pull request of repo is tracked.
+func (t *TrackedPullRequests) tracks(repo string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.prs {
+		if t.prs[i].Repository.Key() == repo {
+			return true
+		}
 	}
-	from = ti.prs[0].UpdatedAt.Time
-	to = from
+	return false
+}
+
+// getUpdateTimeRange returns the updated time range of the tracked pull
+// requests of repo, or of all of them if repo is empty.
+func (ti *TrackedPullRequests) getUpdateTimeRange(repo string) (from time.Time, to time.Time) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	first := true
 	for _, pr := range ti.prs {
+		if repo != "" && pr.Repository.Key() != repo {
+			continue
+		}
+		if first {
+			from = pr.UpdatedAt.Time
+			to = from
+			first = false
+		}
 		if pr.UpdatedAt.Time.After(to) {
 			to = pr.UpdatedAt.Time
 		}
@@ -141,32 +449,112 @@ func (ti *TrackedPullRequests) getUpdateTimeRange() (from time.Time, to time.Tim
 			from = pr.UpdatedAt.Time
 		}
 	}
+	if first {
+		// if we don't have any tracked things, we initialize from 2 days ago
+		from = time.Now().Add(-48 * time.Hour)
+		to = from
+	}
 	return
 }
 
-func (ti *TrackedPullRequests) Update(from time.Time) (err error, fetched int, added int) {
-	var updated []PullRequest
-	updated, err = getPullRequestsFrom("pingcap", "tidb", from, 20, 500)
+// Update fetches the pull requests of repo updated since the window start of
+// cp, resuming from its cursor. Every page is added right away and followed by
+// a call to checkpoint with the cursor of cp moved past the page.
+func (ti *TrackedPullRequests) Update(repo RepositoryConfig, st *SyncState, cp *Checkpoint, checkpoint func() error) (err error, fetched int, added int) {
+	_, err = getPullRequestsFrom(repo.Owner, repo.Name, cp.From, config.Batch.PullRequests, config.Batch.Limit, cp.cursor(), func(page []PullRequest, cursor githubv4.String) error {
+		fetched += len(page)
+		n, _ := ti.merge(page, cp.Past)
+		added += n
+		st.advance(cp, cursor)
+		return checkpoint()
+	})
 	if err != nil {
 		log.Printf("error fetching prs %v", err)
-		return
 	}
-	fetched = len(updated)
-	original := len(ti.prs)
-	ti.Add(updated)
-	added = len(ti.prs) - original
+	return
+}
+
+// How a cross referencing pull request was told to be a cherry-pick, from
+// the most to the least certain.
+const (
+	cherryPickByBody    = "body"
+	cherryPickByHeadRef = "head ref"
+	cherryPickByLabel   = "label"
+)
+
+var (
+	// ti-chi-bot opens its cherry-picks with "This is an automated
+	// cherry-pick of #1234" from a branch like cherry-pick-1234-to-release-5.4
+	// and labels them type/cherry-pick-for-release-5.4.
+	cherryPickBodyRe    = regexp.MustCompile(`(?i)cherry[- ]pick of #(\d+)`)
+	cherryPickHeadRefRe = regexp.MustCompile(`^cherry-pick-(\d+)-to-`)
+	cherryPickLabelRe   = regexp.MustCompile(`^type/cherry-pick-for-(.+)$`)
+)
+
+// cherryPick links a pull request to one cherry-picking it, Reason tells how
+// the link was found.
+type cherryPick struct {
+	PR     PullRequestWithoutTimelineItems
+	Reason string
+}
+
+// cherryPickReason tells whether cpr cherry-picks pr and how that shows,
+// empty if it doesn't. The body marker and the head ref name the pull request
+// picked, a cherry-pick naming another one is not taken for one of pr
+// whatever its label. The label, to the base branch of cpr, only tells cpr is
+// a cherry-pick, it is taken for one of pr as it cross references pr from
+// another branch. The title is no marker: a squash merge ends the title of
+// every pr with its own number, and a follow-up may well mention pr's.
+func cherryPickReason(pr *PullRequestWithoutTimelineItems, cpr *CrossReferencingPullRequest) string {
+	if cpr.Number == 0 || cpr.Key() == pr.Key() {
+		return ""
+	}
+	number := strconv.Itoa(int(pr.Number))
+	sameRepo := cpr.Repository.Key() == pr.Repository.Key()
+	named := false
+	for _, m := range cherryPickBodyRe.FindAllStringSubmatch(string(cpr.Body), -1) {
+		if sameRepo && m[1] == number {
+			return cherryPickByBody
+		}
+		named = true
+	}
+	if m := cherryPickHeadRefRe.FindStringSubmatch(string(cpr.HeadRefName)); m != nil {
+		if sameRepo && m[1] == number {
+			return cherryPickByHeadRef
+		}
+		named = true
+	}
+	if named || cpr.BaseRefName == pr.BaseRefName {
+		return ""
+	}
+	for _, l := range cpr.Labels.Nodes {
+		if m := cherryPickLabelRe.FindStringSubmatch(string(l.Name)); m != nil && m[1] == string(cpr.BaseRefName) {
+			return cherryPickByLabel
+		}
+	}
+	return ""
+}
+
+// cherryPicksOf returns the pull requests cross referencing pr that cherry-pick
+// it to another branch.
+func cherryPicksOf(pr *PullRequest) (picks []cherryPick) {
+	for _, edge := range pr.TimelineItems.Edges {
+		cpr := edge.Node.CrossReferencedEvent.Source.PullRequest
+		if reason := cherryPickReason(&pr.PullRequestWithoutTimelineItems, &cpr); reason != "" {
+			picks = append(picks, cherryPick{PR: cpr.PullRequestWithoutTimelineItems, Reason: reason})
+		}
+	}
 	return
 }
 
 func (t *TrackedPullRequests) PopulateCherryPickedTo() {
-	t.cherryPickedTo = make(map[githubv4.ID][]githubv4.ID)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cherryPickedTo = make(map[githubv4.ID][]cherryPick)
 	for _, pr := range t.prs {
-		for _, edge := range pr.TimelineItems.Edges {
-			cpr := edge.Node.CrossReferencedEvent.Source.PullRequest
-			if cpr.Number != 0 && strings.HasPrefix(string(cpr.Title), string(pr.Title)) {
-				t.cherryPickedTo[pr.ID] = append(t.cherryPickedTo[pr.ID], cpr.ID)
-				t.add(PullRequest{PullRequestWithoutTimelineItems: cpr})
-			}
+		for _, cp := range cherryPicksOf(&pr) {
+			t.cherryPickedTo[pr.ID] = append(t.cherryPickedTo[pr.ID], cp)
+			t.addStub(PullRequest{PullRequestWithoutTimelineItems: cp.PR})
 		}
 	}
 
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/shurcooL/githubv4"
+)
+
+func TestCherryPickReason(t *testing.T) {
+	pr := PullRequestWithoutTimelineItems{Number: 102, Title: "planner: fix wrong join order", BaseRefName: "master"}
+	pr.Repository.Owner.Login, pr.Repository.Name = "pingcap", "tidb"
+
+	tests := []struct {
+		name   string
+		cpr    func(cpr *CrossReferencingPullRequest)
+		reason string
+	}{
+		{"body", func(cpr *CrossReferencingPullRequest) { cpr.Body = "cherry-pick of #102" }, cherryPickByBody},
+		{"head ref", func(cpr *CrossReferencingPullRequest) { cpr.HeadRefName = "cherry-pick-102-to-release-5.4" }, cherryPickByHeadRef},
+		{"label", func(cpr *CrossReferencingPullRequest) {
+			cpr.Labels.Nodes = append(cpr.Labels.Nodes, struct{ Name githubv4.String }{"type/cherry-pick-for-release-5.4"})
+		}, cherryPickByLabel},
+		{"label of another branch", func(cpr *CrossReferencingPullRequest) {
+			cpr.Labels.Nodes = append(cpr.Labels.Nodes, struct{ Name githubv4.String }{"type/cherry-pick-for-release-5.3"})
+		}, ""},
+		// a squash merge ends every title with a number, it tells nothing
+		{"title ending in the pr", func(cpr *CrossReferencingPullRequest) { cpr.Title = "planner: fix wrong join order (#102)" }, ""},
+		{"title of the picked pr only", func(cpr *CrossReferencingPullRequest) { cpr.Title = "planner: fix wrong join order again" }, ""},
+		{"title of another pr", func(cpr *CrossReferencingPullRequest) { cpr.Title = "planner: fix wrong join order (#99)" }, ""},
+		{"body naming another pr", func(cpr *CrossReferencingPullRequest) {
+			cpr.Body = "cherry-pick of #99"
+			cpr.Title = "planner: fix wrong join order (#102)"
+		}, ""},
+		{"head ref naming another pr", func(cpr *CrossReferencingPullRequest) {
+			cpr.HeadRefName = "cherry-pick-99-to-release-5.4"
+			cpr.Labels.Nodes = append(cpr.Labels.Nodes, struct{ Name githubv4.String }{"type/cherry-pick-for-release-5.4"})
+		}, ""},
+		{"body of another repository", func(cpr *CrossReferencingPullRequest) {
+			cpr.Repository.Name = "tikv"
+			cpr.Body = "cherry-pick of #102"
+		}, ""},
+		{"same base branch", func(cpr *CrossReferencingPullRequest) {
+			cpr.BaseRefName = "master"
+			cpr.Title = "planner: fix wrong join order (#102)"
+		}, ""},
+		{"the pr itself", func(cpr *CrossReferencingPullRequest) {
+			cpr.Number = 102
+			cpr.Body = "cherry-pick of #102"
+		}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cpr := CrossReferencingPullRequest{}
+			cpr.Number, cpr.BaseRefName = 103, "release-5.4"
+			cpr.Repository.Owner.Login, cpr.Repository.Name = "pingcap", "tidb"
+			tt.cpr(&cpr)
+			if got := cherryPickReason(&pr, &cpr); got != tt.reason {
+				t.Errorf("cherryPickReason = %q, want %q", got, tt.reason)
+			}
+		})
+	}
+}
+
+func TestCherryPickMarkers(t *testing.T) {
+	var cpr CrossReferencingPullRequest
+	body := `{"number": 103, "body": "This is an automated cherry-pick of #102\n\n### What problem does this PR solve?\n..."}`
+	if err := json.Unmarshal([]byte(body), &cpr); err != nil {
+		t.Fatal(err)
+	}
+	if cpr.Body != "cherry-pick of #102" {
+		t.Errorf("body kept as %q, want the marker only", cpr.Body)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shurcooL/githubv4"
+)
+
+type RateLimit struct {
+	Cost      githubv4.Int
+	Remaining githubv4.Int
+	ResetAt   githubv4.DateTime
+}
+
+// RateLimited is embedded by every query, so the answer tells what the query
+// cost and how much of the budget is left.
+type RateLimited struct {
+	RateLimit RateLimit
+}
+
+func (q *RateLimited) rateLimit() *RateLimit {
+	return &q.RateLimit
+}
+
+// rateLimitedFetcher keeps a Fetcher within the GitHub rate limit. It waits for
+// the reset once the budget runs low, retries secondary rate limits and server
+// errors with exponential backoff, and accounts for the cost of the run.
+type rateLimitedFetcher struct {
+	next Fetcher
+	// inflight bounds the queries running at the same time, all workers of a
+	// sync share it along with the budget.
+	inflight chan struct{}
+	// pool, if set, answers for the budget since the queries spread over its
+	// tokens.
+	pool *tokenPool
+
+	mu        sync.Mutex
+	remaining int
+	resetAt   time.Time
+	queries   int
+	cost      int
+	retries   int
+	waited    time.Duration
+}
+
+func newRateLimitedFetcher(next Fetcher) *rateLimitedFetcher {
+	return &rateLimitedFetcher{next: next, inflight: make(chan struct{}, config.Concurrency), remaining: -1}
+}
+
+func (f *rateLimitedFetcher) Query(ctx context.Context, q interface{}, variables map[string]interface{}) error {
+	return f.do(ctx, func() error {
+		err := f.next.Query(ctx, q, variables)
+		if r, ok := q.(interface{ rateLimit() *RateLimit }); ok {
+			f.observe(r.rateLimit())
+		}
+		return err
+	})
+}
+
+func (f *rateLimitedFetcher) Mutate(ctx context.Context, m interface{}, input githubv4.Input, variables map[string]interface{}) error {
+	return f.do(ctx, func() error {
+		return f.next.Mutate(ctx, m, input, variables)
+	})
+}
+
+func (f *rateLimitedFetcher) do(ctx context.Context, call func() error) error {
+	for attempt := 0; ; attempt++ {
+		if err := f.waitForBudget(ctx); err != nil {
+			return err
+		}
+		f.inflight <- struct{}{}
+		err := call()
+		<-f.inflight
+		f.mu.Lock()
+		f.queries++
+		f.mu.Unlock()
+		if err == nil {
+			return nil
+		}
+		var wait time.Duration
+		switch {
+		case isPrimaryRateLimit(err):
+			f.mu.Lock()
+			f.remaining = 0
+			f.mu.Unlock()
+			if remaining, resetAt := f.budget(); remaining >= 0 && remaining < config.RateLimit.MinRemaining {
+				wait = time.Until(resetAt)
+			}
+			if wait <= 0 {
+				wait = backoff(attempt)
+			}
+		case isRetryable(err):
+			wait = backoff(attempt)
+		default:
+			return err
+		}
+		if attempt >= config.RateLimit.MaxRetries {
+			log.Printf("giving up after %d retries: %v", attempt, err)
+			return err
+		}
+		log.Printf("retry in %v after %v", wait.Round(time.Millisecond), err)
+		if err := f.sleep(ctx, wait); err != nil {
+			return err
+		}
+		f.mu.Lock()
+		f.retries++
+		f.mu.Unlock()
+	}
+}
+
+// waitForBudget sleeps until the rate limit resets if the remaining budget is
+// below the configured minimum.
+func (f *rateLimitedFetcher) waitForBudget(ctx context.Context) error {
+	remaining, resetAt := f.budget()
+	wait := time.Until(resetAt)
+	low := remaining >= 0 && remaining < config.RateLimit.MinRemaining
+	if !low || wait <= 0 {
+		return nil
+	}
+	// give the reset a moment on GitHub's side
+	wait += time.Second
+	log.Printf("%d points of rate limit left, waiting %v for the reset", remaining, wait.Round(time.Second))
+	if err := f.sleep(ctx, wait); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.remaining = -1
+	f.mu.Unlock()
+	return nil
+}
+
+// budget returns the remaining rate limit and its reset, -1 if unknown.
+func (f *rateLimitedFetcher) budget() (int, time.Time) {
+	if f.pool != nil {
+		return f.pool.Budget()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.remaining, f.resetAt
+}
+
+func (f *rateLimitedFetcher) observe(r *RateLimit) {
+	if r.ResetAt.IsZero() {
+		// the answer carried no rate limit, like an error or a fixture
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.remaining = int(r.Remaining)
+	f.resetAt = r.ResetAt.Time
+	f.cost += int(r.Cost)
+}
+
+func (f *rateLimitedFetcher) sleep(ctx context.Context, d time.Duration) error {
+	f.mu.Lock()
+	f.waited += d
+	f.mu.Unlock()
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Summary logs what the run cost.
+func (f *rateLimitedFetcher) Summary() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	log.Printf("%d queries cost %d points of rate limit, %d retries, %v waited, %d points left until %s",
+		f.queries, f.cost, f.retries, f.waited.Round(time.Second), f.remaining, f.resetAt.Format(time.RFC3339))
+}
+
+// backoff returns the exponential delay of the given attempt with jitter, within
+// the configured maximum.
+func backoff(attempt int) time.Duration {
+	d := config.RateLimit.MaxBackoff
+	if attempt < 20 {
+		if exp := time.Second << uint(attempt); exp < d {
+			d = exp
+		}
+	}
+	// full delay at most, half of it at least
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func isPrimaryRateLimit(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "api rate limit exceeded") || strings.Contains(msg, "rate_limited")
+}
+
+// isRetryable tells the errors worth another try: secondary rate limits,
+// server errors and timeouts.
+func isRetryable(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{
+		"secondary rate limit",
+		"abuse detection",
+		"non-200 ok status code: 5",
+		"timeout",
+		"connection reset",
+		"unexpected eof",
+	} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// releaseTags finds the release tags containing the merge commits of the
+// closers, nil when no repository has a clone configured.
+var releaseTags *tagResolver
+
+// tagCache is what the tag resolver keeps between runs. Tags lists the
+// release tags of each repository in the order they were first seen, a
+// commit is checked against the ones past its Checked only, as a tag once
+// containing a commit always does.
+type tagCache struct {
+	Pattern string
+	Tags    map[string][]string
+	// Commits is keyed by owner/name@sha.
+	Commits map[string]*commitTags
+}
+
+type commitTags struct {
+	Checked int
+	Tags    []string `json:",omitempty"`
+}
+
+// tagResolver answers git tag --contains from the local clones of the tracked
+// repositories.
+type tagResolver struct {
+	mu      sync.Mutex
+	path    string
+	pattern string
+	clones  map[string]string
+	cache   tagCache
+	// listed tells the repositories whose tags were listed by this run.
+	listed map[string]bool
+	// failed keeps the commits git couldn't tell about in this run.
+	failed map[string]bool
+	dirty  bool
+}
+
+// newTagResolver loads the cache of c for the repositories of repos with a
+// clone, configured or discovered.
+func newTagResolver(c *Config, repos []RepositoryConfig) *tagResolver {
+	clones := make(map[string]string)
+	for _, repo := range repos {
+		if clone := c.CloneOf(repo); clone != "" {
+			clones[repo.String()] = clone
+		}
+	}
+	if len(clones) == 0 {
+		return nil
+	}
+	r := &tagResolver{
+		path:    c.Releases.Cache,
+		pattern: c.Releases.TagPattern,
+		clones:  clones,
+		listed:  make(map[string]bool),
+		failed:  make(map[string]bool),
+	}
+	data, err := ioutil.ReadFile(r.path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("read release tag cache %s: %v", r.path, err)
+	} else if err == nil {
+		if err := json.Unmarshal(data, &r.cache); err != nil {
+			log.Printf("decode release tag cache %s: %v", r.path, err)
+		}
+	}
+	if r.cache.Pattern != r.pattern {
+		// the tags checked so far were of another pattern
+		r.cache = tagCache{Pattern: r.pattern}
+	}
+	if r.cache.Tags == nil {
+		r.cache.Tags = make(map[string][]string)
+	}
+	if r.cache.Commits == nil {
+		r.cache.Commits = make(map[string]*commitTags)
+	}
+	log.Printf("load release tags of %d commits from %s", len(r.cache.Commits), r.path)
+	return r
+}
+
+// git runs a git command in the clone dir and returns its output.
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// listTags appends the release tags of repo not seen before, once a run.
+func (r *tagResolver) listTags(repo, clone string) error {
+	if r.listed[repo] {
+		return nil
+	}
+	out, err := git(clone, "tag", "--list", r.pattern)
+	if err != nil {
+		return err
+	}
+	r.listed[repo] = true
+	known := make(map[string]bool)
+	for _, tag := range r.cache.Tags[repo] {
+		known[tag] = true
+	}
+	added := 0
+	for _, tag := range strings.Fields(out) {
+		if !known[tag] {
+			r.cache.Tags[repo] = append(r.cache.Tags[repo], tag)
+			added++
+		}
+	}
+	if added != 0 {
+		r.dirty = true
+	}
+	log.Printf("%d release tags of %s, %d new", len(r.cache.Tags[repo]), repo, added)
+	return nil
+}
+
+// isAncestor tells whether commit is reachable from tag.
+func isAncestor(clone, commit, tag string) (bool, error) {
+	err := exec.Command("git", "-C", clone, "merge-base", "--is-ancestor", commit, tag).Run()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("git merge-base --is-ancestor %s %s: %v", commit, tag, err)
+	}
+	return true, nil
+}
+
+// Contains returns the release tags of repo containing commit, in version
+// order. It is nil for a repository without a clone or a commit the clone
+// doesn't have.
+func (r *tagResolver) Contains(repo, commit string) []string {
+	if r == nil || commit == "" {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clone, ok := r.clones[repo]
+	if !ok {
+		return nil
+	}
+	key := repo + "@" + commit
+	if r.failed[key] {
+		return nil
+	}
+	if err := r.listTags(repo, clone); err != nil {
+		log.Printf("list release tags of %s: %v", repo, err)
+		r.failed[key] = true
+		return nil
+	}
+	known := r.cache.Tags[repo]
+	ct, ok := r.cache.Commits[key]
+	if !ok {
+		out, err := git(clone, "tag", "--list", r.pattern, "--contains", commit)
+		if err != nil {
+			log.Printf("release tags of %s: %v, fetch %s to have it", key, err, clone)
+			r.failed[key] = true
+			return nil
+		}
+		ct = &commitTags{Checked: len(known), Tags: strings.Fields(out)}
+		r.cache.Commits[key] = ct
+		r.dirty = true
+	}
+	for ; ct.Checked < len(known); ct.Checked++ {
+		tag := known[ct.Checked]
+		contained, err := isAncestor(clone, commit, tag)
+		if err != nil {
+			log.Printf("release tags of %s: %v", key, err)
+			r.failed[key] = true
+			break
+		}
+		if contained {
+			ct.Tags = append(ct.Tags, tag)
+		}
+		r.dirty = true
+	}
+	sort.Slice(ct.Tags, func(i, j int) bool { return versionLess(ct.Tags[i], ct.Tags[j]) })
+	return append([]string(nil), ct.Tags...)
+}
+
+// Save writes the cache if the run added to it.
+func (r *tagResolver) Save() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.dirty {
+		return nil
+	}
+	data, err := json.MarshalIndent(&r.cache, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := replaceFile(tmp, r.path); err != nil {
+		return err
+	}
+	r.dirty = false
+	log.Printf("saved release tags of %d commits to %s", len(r.cache.Commits), r.path)
+	return nil
+}
+
+// versionChunks splits a tag into its runs of digits and of the rest.
+func versionChunks(s string) []string {
+	var chunks []string
+	for len(s) != 0 {
+		digit := unicode.IsDigit(rune(s[0]))
+		i := 1
+		for i < len(s) && unicode.IsDigit(rune(s[i])) == digit {
+			i++
+		}
+		chunks = append(chunks, s[:i])
+		s = s[i:]
+	}
+	return chunks
+}
+
+// versionLess orders tags like v5.3.10 after v5.3.9, and a pre-release like
+// v6.0.0-alpha before v6.0.0.
+func versionLess(a, b string) bool {
+	ca, cb := versionChunks(a), versionChunks(b)
+	for i := 0; i < len(ca) && i < len(cb); i++ {
+		x, y := ca[i], cb[i]
+		if x == y {
+			continue
+		}
+		if unicode.IsDigit(rune(x[0])) && unicode.IsDigit(rune(y[0])) {
+			x, y = strings.TrimLeft(x, "0"), strings.TrimLeft(y, "0")
+			if len(x) != len(y) {
+				return len(x) < len(y)
+			}
+		}
+		return x < y
+	}
+	if len(ca) > len(cb) {
+		return strings.HasPrefix(ca[len(cb)], "-")
+	}
+	if len(cb) > len(ca) {
+		return !strings.HasPrefix(cb[len(ca)], "-")
+	}
+	return false
+}
+
+// fixedIn returns the first release tag of the closer and of each of its
+// cherry-picks, the releases a fix first shipped in on every branch.
+func fixedIn(closer *CloserPRInfo, cherryPicks []*CloserPRInfo) []string {
+	seen := make(map[string]bool)
+	var tags []string
+	for _, by := range append([]*CloserPRInfo{closer}, cherryPicks...) {
+		if len(by.Refs) != 0 && !seen[by.Refs[0]] {
+			seen[by.Refs[0]] = true
+			tags = append(tags, by.Refs[0])
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return versionLess(tags[i], tags[j]) })
+	return tags
+}
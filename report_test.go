@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateTrackTable(t *testing.T) {
+	a, _ := syncFixtures(t)
+	content, err := generateTrackTable(a, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the open bug 104 is neither assigned, linked nor picked
+	row := "| [#104](https://github.com/pingcap/tidb/issues/104)&#x2757; | critical |"
+	if !strings.Contains(content, row) {
+		t.Errorf("no row %q in the report:\n%s", row, content)
+	}
+	if strings.Contains(content, "#101") {
+		t.Errorf("closed issue 101 in the report:\n%s", content)
+	}
+	written, err := ioutil.ReadFile(config.Report.Output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(written) != content {
+		t.Errorf("%s differs from the report returned", config.Report.Output)
+	}
+}
+
+func TestGenerateTrackTableAsOf(t *testing.T) {
+	a, _ := syncFixtures(t)
+	// issue 104 was created in February, issue 101 closed on March 2nd
+	content, err := generateTrackTable(a, time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, number := range []string{"101", "104"} {
+		if !strings.Contains(content, "[#"+number+"](https://github.com/pingcap/tidb/issues/"+number+")") {
+			t.Errorf("issue %s open on March 1st not in the report:\n%s", number, content)
+		}
+	}
+	if !strings.Contains(content, "updated at 2022-03-01T00:00:00") {
+		t.Errorf("report not dated March 1st:\n%s", content)
+	}
+}
+
+func TestReportToIssue(t *testing.T) {
+	syncFixtures(t)
+	if err := initPostIssueID(); err != nil {
+		t.Fatal(err)
+	}
+	if PostToIssueID != "I_20804" {
+		t.Errorf("report issue id %v, want I_20804", PostToIssueID)
+	}
+	url, err := reportToIssue("content")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "https://github.com/pingcap/tidb/issues/20804" {
+		t.Errorf("reported to %s", url)
+	}
+}
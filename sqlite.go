@@ -0,0 +1,526 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/shurcooL/githubv4"
+)
+
+// sqliteTimeFormat keeps the times sortable as text and readable by the date
+// functions of SQLite.
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+// SQLiteStore keeps the archive in a SQLite database. Unlike the zip archive,
+// a save only writes the issues and pull requests changed since the last one.
+// The schema comes from the migrations under migrations/sqlite.
+type SQLiteStore struct {
+	path string
+	db   *sql.DB
+	lock *os.File
+}
+
+func isSQLitePath(fp string) bool {
+	for _, ext := range []string{".db", ".sqlite", ".sqlite3"} {
+		if strings.HasSuffix(fp, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func OpenSQLiteStore(fp string) (*SQLiteStore, error) {
+	// the migrations run under the lock, two runs starting together don't
+	// both apply them
+	lock, err := lockArchive(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	db, err := sql.Open("sqlite3", fp+"?_foreign_keys=on&_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	// a single connection serializes the writers, SQLite takes one at a time
+	db.SetMaxOpenConns(1)
+	if err := prepareSchema(db, storageSQLite); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("schema of %s: %v", fp, err)
+	}
+	return &SQLiteStore{path: fp, db: db}, nil
+}
+
+// Lock takes the lock of the database. SQLite keeps every save consistent,
+// the lock keeps two syncs from interleaving their pages and sync state.
+func (s *SQLiteStore) Lock() (err error) {
+	if s.lock == nil {
+		s.lock, err = lockArchive(s.path)
+	}
+	return
+}
+
+func (s *SQLiteStore) TryLock() (bool, error) {
+	if s.lock != nil {
+		return true, nil
+	}
+	lock, err := tryLockArchive(s.path)
+	s.lock = lock
+	return lock != nil, err
+}
+
+func (s *SQLiteStore) Unlock() error {
+	if s.lock == nil {
+		return nil
+	}
+	err := s.lock.Close()
+	s.lock = nil
+	return err
+}
+
+func (s *SQLiteStore) Close() error {
+	err := s.db.Close()
+	s.Unlock()
+	return err
+}
+
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeFormat)
+}
+
+// sqliteNullTime stores the zero time as NULL.
+func sqliteNullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return sqliteTime(t)
+}
+
+func nodeID(id githubv4.ID) string {
+	return fmt.Sprint(id)
+}
+
+// Load reads every issue and pull request along with the sync state into a.
+func (s *SQLiteStore) Load(a *Archive) error {
+	start := time.Now()
+	var issues []IssueNode
+	err := s.scanData("SELECT id, data FROM issues ORDER BY updated_at DESC", func(id string, data []byte) {
+		var issue IssueNode
+		if err := json.Unmarshal(data, &issue); err != nil {
+			a.broken = append(a.broken, brokenNode{kind: nodeKindIssue, id: id, where: "issues " + id, err: err})
+			return
+		}
+		issues = append(issues, issue)
+	})
+	if err != nil {
+		return err
+	}
+	var prs []PullRequest
+	err = s.scanData("SELECT id, data FROM pull_requests ORDER BY updated_at DESC", func(id string, data []byte) {
+		var pr PullRequest
+		if err := json.Unmarshal(data, &pr); err != nil {
+			a.broken = append(a.broken, brokenNode{kind: nodeKindPullRequest, id: id, where: "pull_requests " + id, err: err})
+			return
+		}
+		prs = append(prs, pr)
+	})
+	if err != nil {
+		return err
+	}
+	a.Issues.issues = issues
+	a.Issues.reindex()
+	a.PullRequests.prs = prs
+	a.PullRequests.reindex()
+	log.Printf("load %d issues and %d prs", len(issues), len(prs))
+
+	if err := loadHistory(s.db, a.Issues); err != nil {
+		return err
+	}
+	events, err := loadEvents(s.db, "change_events")
+	if err != nil {
+		return err
+	}
+	var seen int64
+	if err := s.db.QueryRow("SELECT value FROM meta WHERE key = 'events_seen'").Scan(&seen); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	a.Events.setLoaded(events, seen)
+	if err := s.loadSyncState(a.Sync); err != nil {
+		return err
+	}
+	log.Printf("data loaded in %v", time.Now().Sub(start))
+	return nil
+}
+
+// scanData calls f with the id and data columns of every row of query.
+func (s *SQLiteStore) scanData(query string, f func(id string, data []byte)) error {
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var data []byte
+		if err := rows.Scan(&id, &data); err != nil {
+			return err
+		}
+		f(id, data)
+	}
+	return rows.Err()
+}
+
+func (s *SQLiteStore) loadSyncState(st *SyncState) error {
+	st.Repositories = make(map[string]*RepoSyncState)
+	rows, err := s.db.Query("SELECT repo, issues_from, issues_to, pull_requests_to, checkpoints FROM sync_state")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var repo, checkpoints string
+		var rs RepoSyncState
+		var times [3]string
+		if err := rows.Scan(&repo, &times[0], &times[1], &times[2], &checkpoints); err != nil {
+			return err
+		}
+		for i, t := range []*time.Time{&rs.IssuesFrom, &rs.IssuesTo, &rs.PullRequestsTo} {
+			if *t, err = time.Parse(time.RFC3339Nano, times[i]); err != nil {
+				return fmt.Errorf("sync state of %s: %v", repo, err)
+			}
+		}
+		if err := json.Unmarshal([]byte(checkpoints), &rs.Checkpoints); err != nil {
+			return fmt.Errorf("sync state of %s: %v", repo, err)
+		}
+		st.Repositories[repo] = &rs
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var discovered string
+	err = s.db.QueryRow("SELECT value FROM meta WHERE key = 'discovered'").Scan(&discovered)
+	if err == sql.ErrNoRows {
+		err = nil
+	} else if err == nil {
+		err = json.Unmarshal([]byte(discovered), &st.Discovered)
+	}
+	log.Printf("load sync state of %d repositories", len(st.Repositories))
+	return err
+}
+
+// Save writes the given issues and pull requests along with the sync state
+// in a single transaction.
+func (s *SQLiteStore) Save(a *Archive, issues []IssueNode, prs []PullRequest, events []ChangeEvent) error {
+	return s.write(func(tx *sql.Tx) error {
+		if _, _, err := upsertIssues(tx, issues); err != nil {
+			return err
+		}
+		if err := saveHistory(tx, a.Issues, issues); err != nil {
+			return err
+		}
+		if _, _, err := upsertPullRequests(tx, prs); err != nil {
+			return err
+		}
+		if err := saveEvents(tx, "change_events", events); err != nil {
+			return err
+		}
+		a.Events.mu.Lock()
+		seen := a.Events.Seen
+		a.Events.mu.Unlock()
+		if _, err := tx.Exec("INSERT INTO meta (key, value) VALUES ('events_seen', ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value", seen); err != nil {
+			return err
+		}
+		return saveSyncState(tx, a.Sync)
+	})
+}
+
+// ReportIssues answers from the issues in memory, they are all loaded anyway.
+func (s *SQLiteStore) ReportIssues(a *Archive, labels []string) ([]Issue, error) {
+	return reportIssues(a.Issues, labels), nil
+}
+
+// Delete removes the rows of the issues and pull requests and vacuums the
+// database, which is what gives the space back to the file system.
+func (s *SQLiteStore) Delete(a *Archive, issues []IssueNode, prs []PullRequest) error {
+	err := s.write(func(tx *sql.Tx) error {
+		for i := range issues {
+			id := nodeID(issues[i].ID)
+			for _, stmt := range []string{
+				"DELETE FROM issues WHERE id = ?",
+				"DELETE FROM labels WHERE node_id = ?",
+				"DELETE FROM assignees WHERE issue_id = ?",
+				"DELETE FROM timeline_edges WHERE node_id = ?",
+				"DELETE FROM closed_by WHERE issue_id = ?",
+				"DELETE FROM issue_history WHERE issue_id = ?",
+			} {
+				if _, err := tx.Exec(stmt, id); err != nil {
+					return err
+				}
+			}
+		}
+		for i := range prs {
+			id := nodeID(prs[i].ID)
+			for _, stmt := range []string{
+				"DELETE FROM pull_requests WHERE id = ?",
+				"DELETE FROM labels WHERE node_id = ?",
+				"DELETE FROM timeline_edges WHERE node_id = ?",
+				"DELETE FROM cherry_picks WHERE pr_id = ?",
+			} {
+				if _, err := tx.Exec(stmt, id); err != nil {
+					return err
+				}
+			}
+		}
+		if first := a.Events.first(); first != 0 {
+			if _, err := tx.Exec("DELETE FROM change_events WHERE seq < ?", first); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := s.db.Exec("VACUUM"); err != nil {
+		return err
+	}
+	// the vacuumed pages go through the write-ahead log, empty it as well
+	_, err = s.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	return err
+}
+
+// Size counts the write-ahead log along with the database.
+func (s *SQLiteStore) Size() (int64, error) {
+	var size int64
+	for _, fp := range []string{s.path, s.path + "-wal"} {
+		info, err := os.Stat(fp)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
+
+func (s *SQLiteStore) write(f func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// stale looks up the stored version of a node, it tells whether the node is
+// new and whether the stored version is more recent than updatedAt. A version
+// as recent is written again, so fsck -repair can replace a broken row with
+// the same version refetched.
+func stale(tx *sql.Tx, table string, id string, updatedAt time.Time) (isNew bool, isStale bool, err error) {
+	var stored string
+	err = tx.QueryRow("SELECT updated_at FROM "+table+" WHERE id = ?", id).Scan(&stored)
+	if err == sql.ErrNoRows {
+		return true, false, nil
+	}
+	if err != nil {
+		return
+	}
+	return false, stored > sqliteTime(updatedAt), nil
+}
+
+func upsertIssues(tx *sql.Tx, issues []IssueNode) (added int, updated int, err error) {
+	for i := range issues {
+		issue := &issues[i]
+		id := nodeID(issue.ID)
+		isNew, isStale, err := stale(tx, "issues", id, issue.UpdatedAt.Time)
+		if err != nil {
+			return added, updated, err
+		}
+		if isStale {
+			continue
+		}
+		data, err := json.Marshal(issue)
+		if err != nil {
+			return added, updated, err
+		}
+		var closedBy interface{}
+		if closer := closerOf(issue); closer != nil {
+			closedBy = nodeID(closer.ID)
+		}
+		_, err = tx.Exec(`INSERT INTO issues (id, owner, repo, number, title, state, url, author, created_at, updated_at, closed_at, severity, closed_by, data)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET owner = excluded.owner, repo = excluded.repo, number = excluded.number,
+				title = excluded.title, state = excluded.state, url = excluded.url, author = excluded.author,
+				created_at = excluded.created_at, updated_at = excluded.updated_at, closed_at = excluded.closed_at,
+				severity = excluded.severity, closed_by = excluded.closed_by, data = excluded.data`,
+			id, string(issue.Repository.Owner.Login), string(issue.Repository.Name), int(issue.Number),
+			string(issue.Title), string(issue.State), string(issue.Url), string(issue.Author.Login),
+			sqliteTime(issue.CreatedAt.Time), sqliteTime(issue.UpdatedAt.Time), sqliteNullTime(issue.ClosedAt.Time),
+			nullString(config.SeverityOf(issueLabels(issue))), closedBy, data)
+		if err != nil {
+			return added, updated, fmt.Errorf("upsert issue %s#%d: %v", issue.Repository.Key(), issue.Number, err)
+		}
+
+		if err := replaceLabels(tx, id, issueLabels(issue)); err != nil {
+			return added, updated, err
+		}
+		if _, err := tx.Exec("DELETE FROM assignees WHERE issue_id = ?", id); err != nil {
+			return added, updated, err
+		}
+		for _, as := range issue.Assignees.Nodes {
+			if _, err := tx.Exec("INSERT OR IGNORE INTO assignees (issue_id, login, assigned_at) VALUES (?, ?, ?)", id, string(as.Login), sqliteNullTime(as.CreatedAt.Time)); err != nil {
+				return added, updated, err
+			}
+		}
+		edges := make([]timelineEdge, 0, len(issue.TimelineItems.Edges))
+		for _, e := range issue.TimelineItems.Edges {
+			source := e.Node.CrossReferencedEvent.Source.PullRequest.ID
+			if e.Node.Typename == "ClosedEvent" {
+				source = e.Node.ClosedEvent.Closer.PullRequest.ID
+			}
+			edges = append(edges, timelineEdge{typename: e.Node.Typename, source: source})
+		}
+		if err := replaceTimelineEdges(tx, id, edges); err != nil {
+			return added, updated, err
+		}
+		if _, err := tx.Exec("DELETE FROM closed_by WHERE issue_id = ?", id); err != nil {
+			return added, updated, err
+		}
+		if closedBy != nil {
+			if _, err := tx.Exec("INSERT INTO closed_by (issue_id, pr_id) VALUES (?, ?)", id, closedBy); err != nil {
+				return added, updated, err
+			}
+		}
+		if isNew {
+			added++
+		} else {
+			updated++
+		}
+	}
+	return added, updated, nil
+}
+
+func upsertPullRequests(tx *sql.Tx, prs []PullRequest) (added int, updated int, err error) {
+	for i := range prs {
+		pr := &prs[i]
+		id := nodeID(pr.ID)
+		isNew, isStale, err := stale(tx, "pull_requests", id, pr.UpdatedAt.Time)
+		if err != nil {
+			return added, updated, err
+		}
+		if isStale {
+			continue
+		}
+		data, err := json.Marshal(pr)
+		if err != nil {
+			return added, updated, err
+		}
+		_, err = tx.Exec(`INSERT INTO pull_requests (id, owner, repo, number, title, state, url, author, base_ref, head_ref, merge_commit, created_at, updated_at, merged_at, data)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET owner = excluded.owner, repo = excluded.repo, number = excluded.number,
+				title = excluded.title, state = excluded.state, url = excluded.url, author = excluded.author,
+				base_ref = excluded.base_ref, head_ref = excluded.head_ref, merge_commit = excluded.merge_commit,
+				created_at = excluded.created_at, updated_at = excluded.updated_at, merged_at = excluded.merged_at, data = excluded.data`,
+			id, string(pr.Repository.Owner.Login), string(pr.Repository.Name), int(pr.Number),
+			string(pr.Title), string(pr.State), string(pr.Url), string(pr.Author.Login),
+			string(pr.BaseRefName), string(pr.HeadRefName), string(pr.MergeCommit.OID),
+			sqliteTime(pr.CreatedAt.Time), sqliteTime(pr.UpdatedAt.Time), sqliteNullTime(pr.MergedAt.Time), data)
+		if err != nil {
+			return added, updated, fmt.Errorf("upsert pr %s#%d: %v", pr.Repository.Key(), pr.Number, err)
+		}
+
+		labels := make([]string, 0, len(pr.Labels.Nodes))
+		for _, l := range pr.Labels.Nodes {
+			labels = append(labels, string(l.Name))
+		}
+		if err := replaceLabels(tx, id, labels); err != nil {
+			return added, updated, err
+		}
+		edges := make([]timelineEdge, 0, len(pr.TimelineItems.Edges))
+		for _, e := range pr.TimelineItems.Edges {
+			edges = append(edges, timelineEdge{typename: e.Node.Typename, source: e.Node.CrossReferencedEvent.Source.PullRequest.ID})
+		}
+		if err := replaceTimelineEdges(tx, id, edges); err != nil {
+			return added, updated, err
+		}
+		if _, err := tx.Exec("DELETE FROM cherry_picks WHERE pr_id = ?", id); err != nil {
+			return added, updated, err
+		}
+		for _, cp := range cherryPicksOf(pr) {
+			if _, err := tx.Exec("INSERT OR IGNORE INTO cherry_picks (pr_id, cherry_pick_id, reason) VALUES (?, ?, ?)", id, nodeID(cp.PR.ID), cp.Reason); err != nil {
+				return added, updated, err
+			}
+		}
+		if isNew {
+			added++
+		} else {
+			updated++
+		}
+	}
+	return added, updated, nil
+}
+
+func replaceLabels(tx *sql.Tx, id string, labels []string) error {
+	if _, err := tx.Exec("DELETE FROM labels WHERE node_id = ?", id); err != nil {
+		return err
+	}
+	for _, l := range labels {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO labels (node_id, name) VALUES (?, ?)", id, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type timelineEdge struct {
+	typename string
+	source   githubv4.ID
+}
+
+func replaceTimelineEdges(tx *sql.Tx, id string, edges []timelineEdge) error {
+	if _, err := tx.Exec("DELETE FROM timeline_edges WHERE node_id = ?", id); err != nil {
+		return err
+	}
+	for i, e := range edges {
+		var source interface{}
+		if e.source != nil {
+			source = nodeID(e.source)
+		}
+		if _, err := tx.Exec("INSERT INTO timeline_edges (node_id, position, type, source_id) VALUES (?, ?, ?, ?)", id, i, e.typename, source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func saveSyncState(tx *sql.Tx, st *SyncState) error {
+	repos, discovered := st.snapshot()
+	for repo, rs := range repos {
+		checkpoints, err := json.Marshal(rs.Checkpoints)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO sync_state (repo, issues_from, issues_to, pull_requests_to, checkpoints) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (repo) DO UPDATE SET issues_from = excluded.issues_from, issues_to = excluded.issues_to,
+				pull_requests_to = excluded.pull_requests_to, checkpoints = excluded.checkpoints`,
+			repo, rs.IssuesFrom.Format(time.RFC3339Nano), rs.IssuesTo.Format(time.RFC3339Nano), rs.PullRequestsTo.Format(time.RFC3339Nano), string(checkpoints))
+		if err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(discovered)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO meta (key, value) VALUES ('discovered', ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value", string(data))
+	return err
+}
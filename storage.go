@@ -0,0 +1,305 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// Storage is where an Archive is kept. The sync loads the archive once and
+// saves the changed nodes after every page, the reports query the issues
+// through it as well, so both see the same data whatever the backend.
+type Storage interface {
+	// Load reads every issue and pull request, the history of the issues, the
+	// change events and the sync state into a.
+	Load(a *Archive) error
+	// Save upserts the issues and pull requests changed since the last save
+	// along with the history of the issues, appends the change events logged
+	// since and writes the sync state of a. A backend that can't write nodes
+	// one by one rewrites all of a.
+	Save(a *Archive, issues []IssueNode, prs []PullRequest, events []ChangeEvent) error
+	// ReportIssues returns the open issues carrying all of labels with their
+	// labels, assignees and the pull requests that will close them.
+	ReportIssues(a *Archive, labels []string) ([]Issue, error)
+	// Delete removes the issues and pull requests -compact dropped from a,
+	// along with the history of the issues and the change events before the
+	// oldest one a keeps, once a is saved without them.
+	Delete(a *Archive, issues []IssueNode, prs []PullRequest) error
+	// Size returns the bytes the archive takes.
+	Size() (int64, error)
+	// Lock keeps the other runs from saving until Unlock. A run that saves
+	// takes it before loading and releases it after its last save, so it
+	// starts from what the previous one saved. Reading needs no lock.
+	Lock() error
+	// TryLock is Lock without the wait, it tells whether it took the lock.
+	TryLock() (bool, error)
+	Unlock() error
+	Close() error
+}
+
+const (
+	storageZip    = "zip"
+	storageSQLite = "sqlite"
+	storageMySQL  = "mysql"
+)
+
+// openStorage opens the backend of c, the MySQL one connects to dsn.
+func openStorage(c StorageConfig, dsn string) (Storage, error) {
+	backend := c.Backend
+	if backend == "" {
+		backend = storageZip
+		if isSQLitePath(c.Path) {
+			backend = storageSQLite
+		}
+	}
+	switch backend {
+	case storageZip:
+		return openZipStorage(c)
+	case storageSQLite:
+		return OpenSQLiteStore(c.Path)
+	case storageMySQL:
+		if dsn == "" {
+			return nil, fmt.Errorf("the mysql storage needs a DSN from -mysql or $MYSQL_URL")
+		}
+		return OpenMySQLStore(dsn)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", backend)
+}
+
+// zipStorage keeps the archive as JSON files in a zip file.
+type zipStorage struct {
+	Path string
+	// Backups is the number of previous archives kept next to Path.
+	Backups int
+	// lock is held from Lock to Unlock, nil for an archive only read like the
+	// source of -import.
+	lock *os.File
+	// rotated tells the backups were rotated by this run, the saves after
+	// every page don't push out the archives of the previous runs.
+	rotated bool
+}
+
+func openZipStorage(c StorageConfig) (*zipStorage, error) {
+	return &zipStorage{Path: c.Path, Backups: c.Backups}, nil
+}
+
+// Load reads the archive, a missing one is taken as empty. The issues and prs
+// are decoded as they are read from the zip, one node at a time.
+func (s *zipStorage) Load(a *Archive) error {
+	start := time.Now()
+	a.Issues.issues, a.PullRequests.prs, a.Issues.history = nil, nil, nil
+	a.Events.Events, a.Events.Seen = nil, 0
+	defer func() {
+		a.Issues.Normalize()
+		a.PullRequests.Normalize()
+	}()
+	r, err := zip.OpenReader(s.Path)
+	if os.IsNotExist(err) {
+		log.Printf("no archive at %s, start from scratch", s.Path)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	hasSync := false
+	for _, f := range r.File {
+		if err := s.loadFile(a, f); err != nil {
+			return fmt.Errorf("%s in %s: %v", f.Name, s.Path, err)
+		}
+		hasSync = hasSync || f.Name == archiveSyncPath
+	}
+	if !hasSync {
+		log.Println("no sync state")
+	}
+	a.Events.setLoaded(a.Events.Events, a.Events.Seen)
+	log.Printf("load %d issues and %d prs, the history of %d issues", len(a.Issues.issues), len(a.PullRequests.prs), len(a.Issues.history))
+	log.Printf("data loaded in %v", time.Now().Sub(start))
+	return nil
+}
+
+// loadFile reads a file of the archive into a, the nodes that don't decode
+// are put aside in a.broken.
+func (s *zipStorage) loadFile(a *Archive, f *zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	var broken []brokenNode
+	name := f.Name
+	switch {
+	case name == archiveIssuesPath || isShard(name, archiveIssuesDir):
+		broken, err = a.Issues.Load(rc, name, name != archiveIssuesPath)
+	case name == archivePRsPath || isShard(name, archivePRsDir):
+		broken, err = a.PullRequests.Load(rc, name, name != archivePRsPath)
+	case isShard(name, archiveHistoryDir):
+		err = a.Issues.LoadHistoryShard(rc, name)
+	case isShard(name, archiveEventsDir):
+		err = a.Events.LoadShard(rc, name)
+	case name == archiveHistoryPath || name == archiveEventsPath || name == archiveSeenPath || name == archiveSyncPath:
+		var data []byte
+		if data, err = ioutil.ReadAll(rc); err != nil {
+			return err
+		}
+		switch name {
+		case archiveHistoryPath:
+			a.Issues.LoadHistory(data)
+		case archiveEventsPath:
+			a.Events.Load(data)
+		case archiveSeenPath:
+			a.Events.LoadSeen(data)
+		case archiveSyncPath:
+			a.Sync.Load(data)
+		}
+	default:
+		log.Printf("skip unknown file %s in %s", name, s.Path)
+	}
+	a.broken = append(a.broken, broken...)
+	return err
+}
+
+// Save writes the whole archive to a temporary file, syncs it and renames it
+// over the old one, so a crash never leaves a half written archive behind.
+// The first save of a run keeps the old archive as the latest backup. The
+// nodes that didn't decode are written back as they were read.
+func (s *zipStorage) Save(a *Archive, issues []IssueNode, prs []PullRequest, events []ChangeEvent) error {
+	// the cursors are taken before the nodes, a worker merges a page before
+	// moving its cursor past it
+	syncState := a.Sync.Save()
+	tmpFilePath := s.Path + ".tmp"
+	err := writeZip(tmpFilePath, func(zw *zip.Writer) error {
+		if err := a.Issues.Save(zw, brokenLines(a.broken, nodeKindIssue, archiveIssuesDir)); err != nil {
+			return err
+		}
+		if err := a.PullRequests.Save(zw, brokenLines(a.broken, nodeKindPullRequest, archivePRsDir)); err != nil {
+			return err
+		}
+		if err := a.Issues.SaveHistory(zw); err != nil {
+			return err
+		}
+		if err := a.Events.Save(zw); err != nil {
+			return err
+		}
+		return writeZipFile(zw, archiveSyncPath, syncState)
+	})
+	if err != nil {
+		return err
+	}
+	if !s.rotated {
+		if err := rotateBackups(s.Path, s.Backups); err != nil {
+			return err
+		}
+		s.rotated = true
+	}
+	// atomically replace the old zip file
+	return replaceFile(tmpFilePath, s.Path)
+}
+
+func (s *zipStorage) ReportIssues(a *Archive, labels []string) ([]Issue, error) {
+	return reportIssues(a.Issues, labels), nil
+}
+
+// Delete has nothing to do, the save rewrote the archive without them.
+func (s *zipStorage) Delete(a *Archive, issues []IssueNode, prs []PullRequest) error {
+	return nil
+}
+
+func (s *zipStorage) Size() (int64, error) {
+	info, err := os.Stat(s.Path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Lock takes the lock of the archive, a lock already held is kept.
+func (s *zipStorage) Lock() (err error) {
+	if s.lock == nil {
+		s.lock, err = lockArchive(s.Path)
+	}
+	return
+}
+
+func (s *zipStorage) TryLock() (bool, error) {
+	if s.lock != nil {
+		return true, nil
+	}
+	lock, err := tryLockArchive(s.Path)
+	s.lock = lock
+	return lock != nil, err
+}
+
+func (s *zipStorage) Unlock() error {
+	if s.lock == nil {
+		return nil
+	}
+	err := s.lock.Close()
+	s.lock = nil
+	return err
+}
+
+func (s *zipStorage) Close() error {
+	return s.Unlock()
+}
+
+// reportIssues answers ReportIssues from the tracked issues in memory.
+func reportIssues(ti *TrackedIssues, labels []string) (result []Issue) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	for k := range ti.issues {
+		issue := &ti.issues[k]
+		if issue.State != "OPEN" || !hasLabels(issue, labels) {
+			continue
+		}
+		i := Issue{
+			Owner:      string(issue.Repository.Owner.Login),
+			Repository: string(issue.Repository.Name),
+			Number:     int(issue.Number),
+			Url:        string(issue.Url),
+			Title:      string(issue.Title),
+			Author:     string(issue.Author.Login),
+		}
+		i.Score, i.Mentor, i.Hint = parseChallenge(string(issue.Body))
+		for _, l := range issue.Labels.Nodes {
+			i.Labels = append(i.Labels, string(l.Name))
+		}
+		for _, as := range issue.Assignees.Nodes {
+			i.Assignees = append(i.Assignees, Assignee{Name: string(as.Login), CreatedAt: as.CreatedAt.Time})
+		}
+		for _, edge := range issue.TimelineItems.Edges {
+			event := edge.Node.CrossReferencedEvent
+			pr := event.Source.PullRequest
+			if !event.WillCloseTarget || pr.Number == 0 {
+				continue
+			}
+			i.LinkedPRs = append(i.LinkedPRs, LinkedPR{
+				Owner:      string(pr.Repository.Owner.Login),
+				Repository: string(pr.Repository.Name),
+				Number:     int(pr.Number),
+				Url:        string(pr.Url),
+				Title:      string(pr.Title),
+				Author:     string(pr.Author.Login),
+			})
+		}
+		result = append(result, i)
+	}
+	// in the order of the MySQL query
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Owner != b.Owner {
+			return a.Owner < b.Owner
+		}
+		if a.Repository != b.Repository {
+			return a.Repository < b.Repository
+		}
+		return a.Number > b.Number
+	})
+	return
+}
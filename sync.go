@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/shurcooL/githubv4"
+)
+
+func repoKey(owner, name string) string {
+	return owner + "/" + name
+}
+
+// RepoSyncState is the sync watermark of a single repository.
+type RepoSyncState struct {
+	// IssuesFrom and IssuesTo bound the updated time window of the issues
+	// fetched so far, IssuesFrom moves back as history gets extended.
+	IssuesFrom     time.Time
+	IssuesTo       time.Time
+	PullRequestsTo time.Time
+	// Checkpoints keeps the unfinished sync windows by their kind.
+	Checkpoints map[string]*Checkpoint `json:",omitempty"`
+}
+
+const (
+	checkpointIssues       = "issues"
+	checkpointPullRequests = "prs"
+	checkpointBackfill     = "backfill"
+)
+
+// Checkpoint is the progress inside a sync window, it is saved after every
+// page so a run killed halfway resumes after Cursor instead of refetching or
+// skipping the window.
+type Checkpoint struct {
+	From   time.Time
+	To     time.Time
+	Cursor string `json:",omitempty"`
+	// Part ends the part of the window being fetched, the search serving too
+	// few results to fetch the whole of it at once.
+	Part *time.Time `json:",omitempty"`
+	// Past tells the window is of the past, fetched by a backfill or the
+	// first sync of a repository. The nodes it finds that weren't tracked
+	// are not logged as opened then.
+	Past bool `json:",omitempty"`
+}
+
+func (cp *Checkpoint) cursor() *githubv4.String {
+	if cp.Cursor == "" {
+		return nil
+	}
+	cursor := githubv4.String(cp.Cursor)
+	return &cursor
+}
+
+// SyncState keeps the watermark of every tracked repository, keyed by
+// owner/name.
+type SyncState struct {
+	// mu guards the watermarks and checkpoints against the sync workers.
+	mu           sync.Mutex
+	Repositories map[string]*RepoSyncState
+	// Discovered lists the repositories found in the configured organizations
+	// by the last successful discovery.
+	Discovered []RepositoryConfig `json:",omitempty"`
+}
+
+func (s *SyncState) Load(data []byte) {
+	if err := json.Unmarshal(data, s); err != nil {
+		log.Println("failed to load sync state", err)
+	}
+	if s.Repositories == nil {
+		s.Repositories = make(map[string]*RepoSyncState)
+	}
+	log.Printf("load sync state of %d repositories", len(s.Repositories))
+}
+
+func (s *SyncState) Save() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		log.Fatal(err)
+	}
+	return data
+}
+
+// snapshot copies the watermarks and the discovered repositories, so they can
+// be written while the sync workers move on.
+func (s *SyncState) snapshot() (map[string]RepoSyncState, []RepositoryConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	repos := make(map[string]RepoSyncState, len(s.Repositories))
+	for key, rs := range s.Repositories {
+		c := *rs
+		c.Checkpoints = make(map[string]*Checkpoint, len(rs.Checkpoints))
+		for kind, cp := range rs.Checkpoints {
+			cp := *cp
+			c.Checkpoints[kind] = &cp
+		}
+		repos[key] = c
+	}
+	return repos, append([]RepositoryConfig(nil), s.Discovered...)
+}
+
+// isNew tells whether repo has no watermark yet and nothing of it is
+// tracked, its first sync fetches what happened before the tracker looked.
+func (s *SyncState) isNew(repo RepositoryConfig, ti *TrackedIssues, tpr *TrackedPullRequests) bool {
+	s.mu.Lock()
+	_, ok := s.Repositories[repo.String()]
+	s.mu.Unlock()
+	return !ok && !ti.tracks(repo.String()) && !tpr.tracks(repo.String())
+}
+
+// Repo returns the watermark of repo, a repository without one is
+// initialized from what is already tracked of it, so archives written before
+// the sync state existed carry on where they were.
+func (s *SyncState) Repo(repo RepositoryConfig, ti *TrackedIssues, tpr *TrackedPullRequests) *RepoSyncState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Repositories == nil {
+		s.Repositories = make(map[string]*RepoSyncState)
+	}
+	key := repo.String()
+	if st, ok := s.Repositories[key]; ok {
+		return st
+	}
+	st := &RepoSyncState{}
+	st.IssuesFrom, st.IssuesTo = ti.getUpdateTimeRange(key)
+	st.PullRequestsTo = st.IssuesTo
+	if _, to := tpr.getUpdateTimeRange(key); to.After(st.PullRequestsTo) {
+		st.PullRequestsTo = to
+	}
+	log.Printf("initialize sync state of %s from %s to %s", key, st.IssuesFrom, st.IssuesTo)
+	s.Repositories[key] = st
+	return st
+}
+
+// checkpoint returns the unfinished window of the given kind, or starts a new
+// one from from to to, of the past if past is true.
+func (s *SyncState) checkpoint(repo RepositoryConfig, rs *RepoSyncState, kind string, from, to time.Time, past bool) *Checkpoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rs.Checkpoints == nil {
+		rs.Checkpoints = make(map[string]*Checkpoint)
+	}
+	if cp, ok := rs.Checkpoints[kind]; ok {
+		log.Printf("resume %s of %s from %s to %s after %q", kind, repo, cp.From, cp.To, cp.Cursor)
+		return cp
+	}
+	cp := &Checkpoint{From: from, To: to, Past: past}
+	rs.Checkpoints[kind] = cp
+	return cp
+}
+
+// advance moves the cursor of cp past a fetched page.
+func (s *SyncState) advance(cp *Checkpoint, cursor githubv4.String) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp.Cursor = string(cursor)
+}
+
+// split has the window of cp fetched up to end first.
+func (s *SyncState) split(cp *Checkpoint, end time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp.Part = &end
+	cp.Cursor = ""
+}
+
+// passPart moves the start of cp past its part fetched whole.
+func (s *SyncState) passPart(cp *Checkpoint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cp.Part != nil {
+		cp.From = *cp.Part
+	} else {
+		cp.From = cp.To
+	}
+	cp.Part = nil
+	cp.Cursor = ""
+}
+
+// move changes the watermarks of rs.
+func (s *SyncState) move(rs *RepoSyncState, f func(rs *RepoSyncState)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(rs)
+}
+
+// done drops the window of the given kind once it is finished.
+func (s *SyncState) done(rs *RepoSyncState, kind string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(rs.Checkpoints, kind)
+}
+
+// update syncs every tracked repository. Repositories and their issue and pull
+// request windows are fetched concurrently, the archive is saved after every
+// page so a failed run resumes where it stopped.
+func update(a *Archive, extend int) {
+	ti, tpr, st := a.Issues, a.PullRequests, a.Sync
+	discover(st)
+	repos := trackedRepositories(st)
+	if len(repos) == 0 {
+		log.Println("no repository to update")
+		return
+	}
+	// the pages are checkpointed as the storage sees fit, every window done
+	// is saved
+	checkpoint := a.Checkpoint
+
+	now := time.Now()
+	p := newPool(config.Concurrency)
+	for _, repo := range repos {
+		repo := repo
+		initial := st.isNew(repo, ti, tpr)
+		rs := st.Repo(repo, ti, tpr)
+		p.Go(func() error {
+			cp := st.checkpoint(repo, rs, checkpointIssues, rs.IssuesTo, now, initial)
+			err, fetched, added := ti.UpdateByTimeRange(repo, st, cp, checkpoint)
+			if err != nil {
+				log.Println("failed to update issue", repo, err)
+				return err
+			}
+			log.Printf("fetched %d added %d to tracked issues of %s", fetched, added, repo)
+			_, to := ti.getUpdateTimeRange(repo.String())
+			st.move(rs, func(rs *RepoSyncState) {
+				if to.After(rs.IssuesTo) {
+					rs.IssuesTo = to
+				}
+			})
+			st.done(rs, checkpointIssues)
+			return a.Save()
+		})
+		p.Go(func() error {
+			cp := st.checkpoint(repo, rs, checkpointPullRequests, rs.PullRequestsTo, now, initial)
+			err, fetched, added := tpr.Update(repo, st, cp, checkpoint)
+			if err != nil {
+				log.Println("failed to update pr", repo, err)
+				return err
+			}
+			log.Printf("fetched %d added %d to tracked prs of %s", fetched, added, repo)
+			_, to := tpr.getUpdateTimeRange(repo.String())
+			st.move(rs, func(rs *RepoSyncState) {
+				if to.After(rs.PullRequestsTo) {
+					rs.PullRequestsTo = to
+				}
+			})
+			st.done(rs, checkpointPullRequests)
+			return a.Save()
+		})
+	}
+	if err := p.Wait(); err != nil {
+		return
+	}
+
+	// every round extends each repository by as many chunks as there are
+	// workers to share, the watermark moves back over the chunks finished in a
+	// row once the round is done
+	chunks := config.Concurrency / len(repos)
+	if chunks < 1 {
+		chunks = 1
+	}
+	var mu sync.Mutex
+	accumulated := 0
+	extendBy := 48 * time.Hour
+	for accumulated < extend {
+		p := newPool(config.Concurrency)
+		finished := make(map[string][]bool)
+		for _, repo := range repos {
+			repo := repo
+			rs := st.Repo(repo, ti, tpr)
+			finished[repo.String()] = make([]bool, chunks)
+			for i := 0; i < chunks; i++ {
+				i := i
+				to := rs.IssuesFrom.Add(-time.Duration(i) * extendBy)
+				from := to.Add(-extendBy)
+				kind := checkpointBackfill + "/" + from.Format(time.RFC3339)
+				p.Go(func() error {
+					cp := st.checkpoint(repo, rs, kind, from, to, true)
+					err, fetched, added := ti.UpdateByTimeRange(repo, st, cp, checkpoint)
+					if err != nil {
+						log.Println("failed to update", repo)
+						return err
+					}
+					st.done(rs, kind)
+					mu.Lock()
+					finished[repo.String()][i] = true
+					accumulated += fetched
+					mu.Unlock()
+					log.Printf("fetched %d added %d to tracked issue of %s from %s to %s\n", fetched, added, repo, from.Format(time.RFC3339), to.Format(time.RFC3339))
+					return nil
+				})
+			}
+		}
+		err := p.Wait()
+		for _, repo := range repos {
+			rs := st.Repo(repo, ti, tpr)
+			st.move(rs, func(rs *RepoSyncState) {
+				for _, ok := range finished[repo.String()] {
+					if !ok {
+						break
+					}
+					rs.IssuesFrom = rs.IssuesFrom.Add(-extendBy)
+				}
+			})
+			log.Printf("issue of %s tracked from %s\n", repo, rs.IssuesFrom.Format(time.RFC3339))
+		}
+		if err := a.Save(); err != nil {
+			log.Println("failed to save", err)
+			return
+		}
+		if err != nil {
+			return
+		}
+		log.Printf("accumulated fetching %d limit by %d\n", accumulated, extend)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/shurcooL/githubv4"
+)
+
+// syncFixtures syncs the default repository from the fixtures of
+// testdata/github.json into a zip archive in a temporary directory, with the
+// default config and the fake GitHub as client until the test ends.
+func syncFixtures(t *testing.T) (*Archive, *FakeGitHub) {
+	t.Helper()
+	fake, err := loadFakeGitHub("testdata/github.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(fake.Close)
+	savedConfig, savedClient := config, client
+	t.Cleanup(func() { config, client = savedConfig, savedClient })
+	dir := t.TempDir()
+	config = defaultConfig()
+	config.Storage = StorageConfig{Path: filepath.Join(dir, "raw.zip")}
+	config.Report.Output = filepath.Join(dir, "index.md")
+	config.Releases.Cache = filepath.Join(dir, "tags.json")
+	client = fake.Client()
+
+	a := NewArchive(&zipStorage{Path: config.Storage.Path})
+	if err := a.Load(); err != nil {
+		t.Fatal(err)
+	}
+	update(a, 0)
+	return a, fake
+}
+
+func issueNumbers(ti *TrackedIssues) []int {
+	var numbers []int
+	for _, issue := range ti.issues {
+		numbers = append(numbers, int(issue.Number))
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+func prNumbers(tpr *TrackedPullRequests) []int {
+	var numbers []int
+	for _, pr := range tpr.prs {
+		numbers = append(numbers, int(pr.Number))
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSync(t *testing.T) {
+	a, fake := syncFixtures(t)
+	if _, missed := fake.Stats(); missed != 0 {
+		t.Errorf("%d queries without fixture", missed)
+	}
+	if got := issueNumbers(a.Issues); !equalInts(got, []int{101, 104}) {
+		t.Errorf("tracked issues %v, want [101 104]", got)
+	}
+	if got := prNumbers(a.PullRequests); !equalInts(got, []int{102, 103}) {
+		t.Errorf("tracked prs %v, want [102 103]", got)
+	}
+
+	issue, ok := a.Issues.Get("pingcap/tidb", 101)
+	if !ok {
+		t.Fatal("issue 101 not tracked")
+	}
+	// the first page of labels ends at severity/major, the rest is fetched
+	// by a follow-up query
+	labels := issueLabels(issue)
+	if len(labels) != 4 || labels[3] != "sig/planner" {
+		t.Errorf("labels of issue 101 %v, want the truncated connection completed", labels)
+	}
+	if issue.Labels.PageInfo.HasNextPage {
+		t.Error("labels of issue 101 still have a next page")
+	}
+	// so is the timeline of its closer, the cherry-pick is on the second page
+	closer := closerOf(issue)
+	if closer == nil || closer.TimelineItems.PageInfo.HasNextPage || len(cherryPicksOf(closer)) != 1 {
+		t.Errorf("closer of issue 101 %+v, want its timeline completed", closer)
+	}
+
+	rs := a.Sync.Repositories["pingcap/tidb"]
+	if rs == nil {
+		t.Fatal("no sync state of pingcap/tidb")
+	}
+	if len(rs.Checkpoints) != 0 {
+		t.Errorf("checkpoints %v left after a finished sync", rs.Checkpoints)
+	}
+
+	// every page was saved, a new run loads what the sync fetched
+	b := NewArchive(&zipStorage{Path: config.Storage.Path})
+	if err := b.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := issueNumbers(b.Issues); !equalInts(got, []int{101, 104}) {
+		t.Errorf("reloaded issues %v, want [101 104]", got)
+	}
+	if got := prNumbers(b.PullRequests); !equalInts(got, []int{102, 103}) {
+		t.Errorf("reloaded prs %v, want [102 103]", got)
+	}
+	if _, ok := b.Sync.Repositories["pingcap/tidb"]; !ok {
+		t.Error("sync state of pingcap/tidb not saved")
+	}
+}
+
+func TestSyncLinking(t *testing.T) {
+	a, _ := syncFixtures(t)
+	ti, tpr := a.Issues, a.PullRequests
+	ti.PopulateClosedBy(tpr)
+	tpr.PopulateCherryPickedTo()
+
+	closed, _ := ti.Get("pingcap/tidb", 101)
+	closer, ok := tpr.byID(ti.closedBy[closed.ID])
+	if !ok || closer.Number != 102 {
+		t.Fatalf("issue 101 closed by %v, want pr 102", ti.closedBy[closed.ID])
+	}
+	open, _ := ti.Get("pingcap/tidb", 104)
+	if by, ok := ti.closedBy[open.ID]; ok {
+		t.Errorf("open issue 104 closed by %v", by)
+	}
+	picks := tpr.cherryPickedTo[closer.ID]
+	if len(picks) != 1 || picks[0].PR.Number != 103 || picks[0].Reason != cherryPickByBody {
+		t.Fatalf("cherry-picks of pr 102 %+v, want pr 103 by body", picks)
+	}
+
+	infos := GetClosedIssueInfo(ti, tpr, "")
+	if len(infos) != 1 {
+		t.Fatalf("%d closed issue infos, want 1", len(infos))
+	}
+	info := infos[0]
+	if info.Number != 101 || info.Severity != "major" || len(info.AffectedVersions) != 1 || info.AffectedVersions[0] != "5.4" {
+		t.Errorf("closed issue info %+v", info)
+	}
+	if info.ClosedByPR == nil || info.ClosedByPR.Number != 102 || info.ClosedByPR.MergeTarget != "master" {
+		t.Errorf("closed by %+v, want pr 102 to master", info.ClosedByPR)
+	}
+	if len(info.CloserCherryPicked) != 1 {
+		t.Fatalf("closer cherry-picked to %+v, want pr 103", info.CloserCherryPicked)
+	}
+	cp := info.CloserCherryPicked[0]
+	if cp.Number != 103 || cp.MergeTarget != "release-5.4" || cp.CherryPickReason != cherryPickByBody {
+		t.Errorf("cherry-pick %+v, want pr 103 to release-5.4 by body", cp)
+	}
+}
+
+func TestSyncLinkingStubs(t *testing.T) {
+	a, _ := syncFixtures(t)
+	ti, tpr := a.Issues, a.PullRequests
+	// the closer and its cherry-pick are only known from the timelines
+	tpr.drop(map[githubv4.ID]bool{"PR_102": true, "PR_103": true})
+	tpr.takeEvents()
+	ti.PopulateClosedBy(tpr)
+	tpr.PopulateCherryPickedTo()
+
+	if got := prNumbers(tpr); !equalInts(got, []int{102, 103}) {
+		t.Errorf("prs %v after linking, want the stubs of [102 103]", got)
+	}
+	if events := tpr.takeEvents(); len(events) != 0 {
+		t.Errorf("linking logged %s", formatChanges(events))
+	}
+}
+
+func TestSyncEvents(t *testing.T) {
+	a, _ := syncFixtures(t)
+	// the first sync of a repository finds its past, not changes
+	if events := a.Events.Since(0); len(events) != 0 {
+		t.Errorf("first sync logged %s", formatChanges(events))
+	}
+
+	// an issue new to a repository synced before is opened
+	open, _ := a.Issues.Get("pingcap/tidb", 104)
+	a.Issues.drop(map[githubv4.ID]bool{open.ID: true})
+	update(a, 0)
+	events := a.Events.Since(0)
+	if len(events) != 1 || events[0].Type != EventIssueOpened || events[0].Number != 104 {
+		t.Errorf("second sync logged %s, want issue 104 opened", formatChanges(events))
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"strings"
 	"time"
 
 	"github.com/shurcooL/githubv4"
@@ -13,29 +15,72 @@ type Repository struct {
 	}
 }
 
+func (r Repository) Key() string {
+	return repoKey(string(r.Owner.Login), string(r.Name))
+}
+
+// NumberKey identifies an issue or a pull request by its repository and
+// number, unlike the node ID it can be derived from a URL or a webhook.
+type NumberKey struct {
+	Repo   string
+	Number int
+}
+
+// PageInfo tells whether a connection has more nodes than fetched, the rest
+// are fetched by follow-up queries after EndCursor.
+type PageInfo struct {
+	HasNextPage githubv4.Boolean
+	EndCursor   githubv4.String
+}
+
+type PullRequestTimelineItem struct {
+	Node struct {
+		Typename             string `graphql:"__typename"`
+		CrossReferencedEvent struct {
+			Source struct {
+				PullRequest CrossReferencingPullRequest `graphql:"... on PullRequest"`
+			}
+		} `graphql:"... on CrossReferencedEvent"`
+		IssueComment struct {
+			Author struct {
+				Login githubv4.String
+			}
+			Body githubv4.String
+		} `graphql:"... on IssueComment"`
+	}
+}
+
+// CrossReferencingPullRequest is a pull request in the timeline of another
+// one, its body tells whether it cherry-picks that one.
+type CrossReferencingPullRequest struct {
+	PullRequestWithoutTimelineItems
+	Body CherryPickMarkers
+}
+
+// CherryPickMarkers is the body of a pull request cut down to its "cherry-pick
+// of #N" markers as it is decoded, the rest isn't worth keeping for every
+// cross reference.
+type CherryPickMarkers string
+
+func (m *CherryPickMarkers) UnmarshalJSON(data []byte) error {
+	var body string
+	if err := json.Unmarshal(data, &body); err != nil {
+		return err
+	}
+	*m = CherryPickMarkers(strings.Join(cherryPickBodyRe.FindAllString(body, -1), "\n"))
+	return nil
+}
+
 type PullRequest struct {
 	PullRequestWithoutTimelineItems
 	TimelineItems struct {
-		Edges []struct {
-			Node struct {
-				Typename             string `graphql:"__typename"`
-				CrossReferencedEvent struct {
-					Source struct {
-						PullRequest PullRequestWithoutTimelineItems `graphql:"... on PullRequest"`
-					}
-				} `graphql:"... on CrossReferencedEvent"`
-				IssueComment struct {
-					Author struct {
-						Login githubv4.String
-					}
-					Body githubv4.String
-				} `graphql:"... on IssueComment"`
-			}
-		}
+		PageInfo PageInfo
+		Edges    []PullRequestTimelineItem
 	} `graphql:"timelineItems(first: 15, itemTypes: [CROSS_REFERENCED_EVENT, ISSUE_COMMENT] )"`
 }
 
 type CloserPRInfo struct {
+	Owner       string
 	Repository  string
 	Number      int
 	Title       string
@@ -45,12 +90,15 @@ type CloserPRInfo struct {
 	MergedAt    time.Time
 	Commit      string
 	Refs        []string
+	// CherryPickReason tells how a cherry-pick of the closer was found.
+	CherryPickReason string `json:",omitempty"`
 }
 
 func (pr *PullRequest) getCloserInfo() *CloserPRInfo {
 	by := &CloserPRInfo{}
 	by.Title = string(pr.Title)
 	by.Number = int(pr.Number)
+	by.Owner = string(pr.Repository.Owner.Login)
 	by.Repository = string(pr.Repository.Name)
 	by.Url = string(pr.Url)
 	by.State = string(pr.State)
@@ -58,6 +106,7 @@ func (pr *PullRequest) getCloserInfo() *CloserPRInfo {
 	by.MergedAt = pr.MergedAt.Time
 	by.Commit = string(pr.MergeCommit.OID)
 	if by.Commit != "" {
+		by.Refs = releaseTags.Contains(repoKey(by.Owner, by.Repository), by.Commit)
 	}
 	return by
 }
@@ -102,47 +151,54 @@ type IssueNode struct {
 	ClosedAt   githubv4.DateTime
 	CreatedAt  githubv4.DateTime
 	UpdatedAt  githubv4.DateTime
-	Repository struct {
-		Name  githubv4.String
-		Owner struct {
-			Login githubv4.String
-		}
-	}
-	Labels struct {
-		Nodes []struct {
-			Name githubv4.String
-		}
-	} `graphql:"labels(last: 15)"`
+	Repository Repository
+	Labels     struct {
+		PageInfo PageInfo
+		Nodes    []Label
+	} `graphql:"labels(first: 15)"`
 	Assignees struct {
-		Nodes []struct {
-			Login     githubv4.String
-			CreatedAt githubv4.DateTime
-		}
-	} `graphql:"assignees(last: 5)"`
+		PageInfo PageInfo
+		Nodes    []IssueAssignee
+	} `graphql:"assignees(first: 5)"`
 	TimelineItems struct {
-		Edges []struct {
-			Node struct {
-				Typename             string `graphql:"__typename"`
-				CrossReferencedEvent struct {
-					WillCloseTarget githubv4.Boolean
-					Source          struct {
-						PullRequest PullRequest `graphql:"... on PullRequest"`
-					}
-				} `graphql:"... on CrossReferencedEvent"`
-				ClosedEvent struct {
-					Actor struct {
-						Login githubv4.String
-					}
-					Closer struct {
-						PullRequest PullRequest `graphql:"... on PullRequest"`
-					}
-				} `graphql:"... on ClosedEvent"`
-			}
-		}
+		PageInfo PageInfo
+		Edges    []IssueTimelineItem
 	} `graphql:"timelineItems(first: 20, itemTypes: [CROSS_REFERENCED_EVENT, CLOSED_EVENT] )"`
 }
 
+type Label struct {
+	Name githubv4.String
+}
+
+type IssueAssignee struct {
+	Login     githubv4.String
+	CreatedAt githubv4.DateTime
+}
+
+type IssueTimelineItem struct {
+	Node struct {
+		Typename             string `graphql:"__typename"`
+		CrossReferencedEvent struct {
+			CreatedAt       githubv4.DateTime
+			WillCloseTarget githubv4.Boolean
+			Source          struct {
+				PullRequest PullRequest `graphql:"... on PullRequest"`
+			}
+		} `graphql:"... on CrossReferencedEvent"`
+		ClosedEvent struct {
+			CreatedAt githubv4.DateTime
+			Actor     struct {
+				Login githubv4.String
+			}
+			Closer struct {
+				PullRequest PullRequest `graphql:"... on PullRequest"`
+			}
+		} `graphql:"... on ClosedEvent"`
+	}
+}
+
 type ClosedIssueInfo struct {
+	Repository         string
 	Number             int
 	Title              string
 	Url                string
@@ -151,4 +207,7 @@ type ClosedIssueInfo struct {
 	AffectedVersions   []string
 	ClosedByPR         *CloserPRInfo
 	CloserCherryPicked []*CloserPRInfo
+	// FixedIn lists the first release tag containing the closer or one of its
+	// cherry-picks, on every branch they were merged to.
+	FixedIn []string
 }
@@ -37,12 +37,13 @@ export default function BasicTable(props: { infos: ClosedIssueInfo[] }) {
             <TableCell align="right">Affected Version</TableCell>
             <TableCell align="right">Closed By</TableCell>
             <TableCell align="right">Cherry Picked To</TableCell>
+            <TableCell align="right">Fixed In</TableCell>
           </TableRow>
         </TableHead>
         <TableBody>
           {infos.map((row) => (
             <TableRow
-              key={row.Number}
+              key={`${row.Repository}#${row.Number}`}
               sx={{ "&:last-child td, &:last-child th": { border: 0 } }}
             >
               <TableCell component="th" scope="row">
@@ -85,6 +86,14 @@ export default function BasicTable(props: { infos: ClosedIssueInfo[] }) {
                     );
                   })}
               </TableCell>
+              <TableCell align="right">
+                {row.FixedIn?.map((v) => (
+                  <>
+                    <code>{v}</code>
+                    <br />
+                  </>
+                ))}
+              </TableCell>
             </TableRow>
           ))}
         </TableBody>
@@ -9,9 +9,11 @@ export interface CloserPRInfo {
     MergedAt: string;
     Commit: string;
     Refs: string[];
+    CherryPickReason?: string;
 }
 
 export interface ClosedIssueInfo {
+    Repository: string;
     Number: number;
     Title: string;
     Url: string;
@@ -20,4 +22,6 @@ export interface ClosedIssueInfo {
     AffectedVersions: string[];
     ClosedByPR: CloserPRInfo;
     CloserCherryPicked: CloserPRInfo[];
+    // left out of the infos.json written before the release tags were looked up
+    FixedIn?: string[] | null;
 };
\ No newline at end of file
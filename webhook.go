@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shurcooL/githubv4"
+)
+
+// maxWebhookPayload bounds the body of a delivery, GitHub caps them at 25MB.
+const maxWebhookPayload = 25 << 20
+
+// webhookPayload is the part of an issues, pull_request, issue_comment or
+// pull_request_review delivery the tracker looks at. The REST shaped payload
+// carries neither the timeline nor the closer, so the node is always refetched
+// by its ID.
+type webhookPayload struct {
+	Action string `json:"action"`
+	Issue  *struct {
+		NodeID string `json:"node_id"`
+		Number int    `json:"number"`
+		// PullRequest is set when the issue of an issue_comment is a pull
+		// request.
+		PullRequest *struct{} `json:"pull_request"`
+	} `json:"issue"`
+	PullRequest *struct {
+		NodeID string `json:"node_id"`
+		Number int    `json:"number"`
+	} `json:"pull_request"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+// webhookRetry is how often the deliveries waiting for the lock of the
+// archive are tried again.
+const webhookRetry = time.Minute
+
+// WebhookServer applies GitHub webhook deliveries to the archive between the
+// syncs, so the tracked set doesn't wait for the next one. A delivery is
+// answered as soon as its signature checks, GitHub gives up on a response
+// after 10s, and the worker applies the queued ones in batches.
+type WebhookServer struct {
+	// mu guards the queue against the handlers.
+	mu    sync.Mutex
+	queue []webhookDelivery
+	wake  chan struct{}
+	// archive is reloaded by every batch under the lock of its storage, the
+	// syncs save it in between. It and fetched are the worker's own.
+	archive *Archive
+	// fetched holds the nodes refetched for the deliveries, until a batch
+	// gets the lock and saves them.
+	fetched []webhookNode
+	secret  []byte
+}
+
+// webhookDelivery is a verified delivery waiting for the worker.
+type webhookDelivery struct {
+	id      string
+	event   string
+	payload webhookPayload
+}
+
+// webhookNode is the issue or pull request a delivery was about, as
+// refetched.
+type webhookNode struct {
+	delivery string
+	repo     RepositoryConfig
+	issue    *IssueNode
+	pr       *PullRequest
+}
+
+func NewWebhookServer(a *Archive, secret string) *WebhookServer {
+	return &WebhookServer{archive: a, secret: []byte(secret), wake: make(chan struct{}, 1)}
+}
+
+// verify checks the X-Hub-Signature-256 header against the HMAC of body.
+func (s *WebhookServer) verify(signature string, body []byte) bool {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+func (s *WebhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is accepted", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookPayload))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.verify(r.Header.Get("X-Hub-Signature-256"), body) {
+		log.Printf("reject delivery %s with a bad signature", r.Header.Get("X-GitHub-Delivery"))
+		http.Error(w, "bad signature", http.StatusUnauthorized)
+		return
+	}
+
+	d := webhookDelivery{id: r.Header.Get("X-GitHub-Delivery"), event: r.Header.Get("X-GitHub-Event")}
+	switch d.event {
+	case "ping":
+		fmt.Fprintln(w, "pong")
+		return
+	case "issues", "pull_request", "issue_comment", "pull_request_review":
+	default:
+		log.Printf("ignore %s delivery %s", d.event, d.id)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	if err := json.Unmarshal(body, &d.payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.enqueue(d)
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "queued")
+}
+
+// enqueue queues d for the worker and wakes it up.
+func (s *WebhookServer) enqueue(d webhookDelivery) {
+	s.mu.Lock()
+	s.queue = append(s.queue, d)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run is the worker, it applies the queued deliveries as they come and tries
+// the ones waiting for the lock again every webhookRetry.
+func (s *WebhookServer) Run() {
+	ticker := time.NewTicker(webhookRetry)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.wake:
+		case <-ticker.C:
+		}
+		s.flush()
+	}
+}
+
+// flush refetches the nodes of the queued deliveries, then merges all the
+// fetched ones into the archive as stored if no sync holds its lock. When one
+// does they are kept for the next try, the sync may well fetch them itself.
+func (s *WebhookServer) flush() {
+	s.mu.Lock()
+	queue := s.queue
+	s.queue = nil
+	s.mu.Unlock()
+	for i := range queue {
+		d := &queue[i]
+		n, msg, err := s.fetch(d)
+		if err != nil {
+			log.Printf("failed to fetch %s delivery %s, left to the next sync: %v", d.event, d.id, err)
+		} else if n == nil {
+			log.Printf("%s.%s delivery %s: %s", d.event, d.payload.Action, d.id, msg)
+		} else {
+			s.fetched = append(s.fetched, *n)
+		}
+	}
+	if len(s.fetched) == 0 {
+		return
+	}
+
+	// a sync may have saved the archive since the last batch, saving the copy
+	// loaded then would undo what it did
+	storage := s.archive.storage
+	locked, err := storage.TryLock()
+	if err != nil {
+		log.Printf("failed to lock the archive for %d deliveries: %v", len(s.fetched), err)
+		return
+	}
+	if !locked {
+		log.Printf("archive locked by another run, %d deliveries wait for the next try", len(s.fetched))
+		return
+	}
+	defer storage.Unlock()
+	a := NewArchive(storage)
+	if err := a.Load(); err != nil {
+		log.Printf("failed to load the archive for %d deliveries: %v", len(s.fetched), err)
+		return
+	}
+	s.archive = a
+	for i := range s.fetched {
+		n := &s.fetched[i]
+		log.Printf("delivery %s: %s", n.delivery, s.merge(a, n))
+	}
+	if err := a.Save(); err != nil {
+		log.Printf("failed to save %d deliveries: %v", len(s.fetched), err)
+		return
+	}
+	s.fetched = nil
+}
+
+// fetch refetches the issue or pull request of d. The node is nil for a
+// delivery with nothing to apply, along with why.
+func (s *WebhookServer) fetch(d *webhookDelivery) (*webhookNode, string, error) {
+	payload := &d.payload
+	repo, ok := s.trackedRepository(payload.Repository.FullName)
+	if !ok {
+		return nil, fmt.Sprintf("%s is not tracked", payload.Repository.FullName), nil
+	}
+	if payload.Action == "deleted" && d.event == "issues" {
+		// the node is gone and can't be refetched, the next fsck or compaction
+		// deals with what is left of it
+		return nil, fmt.Sprintf("issue %s#%d deleted", repo, payload.Issue.Number), nil
+	}
+
+	var nodeID string
+	isPullRequest := false
+	switch {
+	case payload.PullRequest != nil:
+		nodeID, isPullRequest = payload.PullRequest.NodeID, true
+	case payload.Issue != nil:
+		nodeID, isPullRequest = payload.Issue.NodeID, payload.Issue.PullRequest != nil
+	default:
+		return nil, "", fmt.Errorf("no issue or pull request in the payload")
+	}
+	if nodeID == "" {
+		return nil, "", fmt.Errorf("no node_id in the payload")
+	}
+
+	n := &webhookNode{delivery: d.id, repo: repo}
+	if isPullRequest {
+		pr, err := getPullRequestByID(githubv4.ID(nodeID))
+		if err != nil {
+			return nil, "", err
+		}
+		n.pr = &pr
+	} else {
+		issue, err := getIssueByID(githubv4.ID(nodeID))
+		if err != nil {
+			return nil, "", err
+		}
+		n.issue = &issue
+	}
+	return n, "", nil
+}
+
+// merge adds the node n to a and returns what was done for the log.
+func (s *WebhookServer) merge(a *Archive, n *webhookNode) string {
+	if n.pr != nil {
+		added, updated := a.PullRequests.Add([]PullRequest{*n.pr})
+		return fmt.Sprintf("pr %s#%d added %d updated %d", n.repo, n.pr.Number, added, updated)
+	}
+	issue := n.issue
+	_, tracked := a.Issues.Get(n.repo.String(), int(issue.Number))
+	if !tracked && !hasLabels(issue, n.repo.Labels) {
+		return fmt.Sprintf("issue %s#%d doesn't carry %v", n.repo, issue.Number, n.repo.Labels)
+	}
+	added, updated := a.Issues.Add([]IssueNode{*issue})
+	return fmt.Sprintf("issue %s#%d added %d updated %d", n.repo, issue.Number, added, updated)
+}
+
+func (s *WebhookServer) trackedRepository(fullName string) (RepositoryConfig, bool) {
+	for _, repo := range trackedRepositories(s.archive.Sync) {
+		if strings.EqualFold(repo.String(), fullName) {
+			return repo, true
+		}
+	}
+	return RepositoryConfig{}, false
+}
+
+// hasLabels tells whether issue carries all of labels, like the label filter
+// of the issues query.
+func hasLabels(issue *IssueNode, labels []string) bool {
+	for _, l := range labels {
+		found := false
+		for _, label := range issue.Labels.Nodes {
+			if string(label.Name) == l {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func getIssueByID(id githubv4.ID) (issue IssueNode, err error) {
+	var query struct {
+		RateLimited
+		Node struct {
+			Issue IssueNode `graphql:"... on Issue"`
+		} `graphql:"node(id: $id)"`
+	}
+	err = client.Query(context.Background(), &query, map[string]interface{}{"id": id})
+	if err != nil {
+		return
+	}
+	issue = query.Node.Issue
+	if issue.ID == nil {
+		err = fmt.Errorf("%v is not an issue", id)
+		return
+	}
+	_, err = completeIssue(&issue)
+	return
+}
+
+func getPullRequestByID(id githubv4.ID) (pr PullRequest, err error) {
+	var query struct {
+		RateLimited
+		Node struct {
+			PullRequest PullRequest `graphql:"... on PullRequest"`
+		} `graphql:"node(id: $id)"`
+	}
+	err = client.Query(context.Background(), &query, map[string]interface{}{"id": id})
+	if err != nil {
+		return
+	}
+	pr = query.Node.PullRequest
+	if pr.ID == nil {
+		err = fmt.Errorf("%v is not a pull request", id)
+		return
+	}
+	_, err = completePullRequest(&pr)
+	return
+}
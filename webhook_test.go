@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWebhookMergesIntoStoredArchive(t *testing.T) {
+	fake := NewFakeGitHub([]FakeGitHubFixture{
+		{
+			Query:     "node(",
+			Variables: map[string]interface{}{"id": "PR_105"},
+			Data:      json.RawMessage(`{"node": ` + testPR(105, "2022-03-06T00:00:00Z") + `}`),
+		},
+	})
+	defer fake.Close()
+	savedConfig, savedClient := config, client
+	defer func() { config, client = savedConfig, savedClient }()
+	config = defaultConfig()
+	client = fake.Client()
+
+	fp := filepath.Join(t.TempDir(), "raw.zip")
+	served := NewArchive(&zipStorage{Path: fp})
+	if err := served.Load(); err != nil {
+		t.Fatal(err)
+	}
+	s := NewWebhookServer(served, "secret")
+
+	// a sync saves the archive after the server loaded it
+	synced := NewArchive(&zipStorage{Path: fp})
+	var pr PullRequest
+	if err := json.Unmarshal([]byte(testPR(103, "2022-03-04T00:00:00Z")), &pr); err != nil {
+		t.Fatal(err)
+	}
+	synced.PullRequests.Add([]PullRequest{pr})
+	if err := synced.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	deliver(t, s, "pull_request", `{"action": "opened", "repository": {"full_name": "pingcap/tidb"}, "pull_request": {"node_id": "PR_105", "number": 105}}`)
+	s.flush()
+
+	stored := NewArchive(&zipStorage{Path: fp})
+	if err := stored.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := prNumbers(stored.PullRequests); !equalInts(got, []int{103, 105}) {
+		t.Errorf("stored prs %v, want [103 105] with the one of the sync kept", got)
+	}
+}
+
+// deliver posts a signed delivery to s and checks it is queued.
+func deliver(t *testing.T, s *WebhookServer, event, body string) {
+	t.Helper()
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(body))
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r.Header.Set("X-GitHub-Event", event)
+	r.Header.Set("X-GitHub-Delivery", "1")
+	r.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("delivery answered %d %s, want 202", w.Code, w.Body)
+	}
+}
+
+func TestWebhookWaitsForTheLock(t *testing.T) {
+	fake := NewFakeGitHub([]FakeGitHubFixture{
+		{
+			Query:     "node(",
+			Variables: map[string]interface{}{"id": "PR_105"},
+			Data:      json.RawMessage(`{"node": ` + testPR(105, "2022-03-06T00:00:00Z") + `}`),
+		},
+	})
+	defer fake.Close()
+	savedConfig, savedClient := config, client
+	defer func() { config, client = savedConfig, savedClient }()
+	config = defaultConfig()
+	client = fake.Client()
+
+	fp := filepath.Join(t.TempDir(), "raw.zip")
+	s := NewWebhookServer(NewArchive(&zipStorage{Path: fp}), "secret")
+	sync := &zipStorage{Path: fp}
+	if err := sync.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	deliver(t, s, "pull_request", `{"action": "opened", "repository": {"full_name": "pingcap/tidb"}, "pull_request": {"node_id": "PR_105", "number": 105}}`)
+	s.flush()
+	if _, err := os.Stat(fp); !os.IsNotExist(err) {
+		t.Fatalf("archive saved while a sync holds the lock: %v", err)
+	}
+	if len(s.fetched) != 1 {
+		t.Fatalf("%d deliveries waiting, want 1", len(s.fetched))
+	}
+
+	if err := sync.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	s.flush()
+	stored := NewArchive(&zipStorage{Path: fp})
+	if err := stored.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := prNumbers(stored.PullRequests); !equalInts(got, []int{105}) {
+		t.Errorf("stored prs %v, want [105] once the lock is released", got)
+	}
+}